@@ -0,0 +1,405 @@
+/*
+admission.go
+
+Incoming connections are vetted (CIDR, GeoIP, Duo) in their own goroutine
+so that a slow ipinfo.io response or an unanswered Duo push only delays the
+client that triggered it and never the listener's accept loop.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// admissionPolicy holds everything needed to decide if a connection may be forwarded
+type admissionPolicy struct {
+	name              string
+	localGeoIP        ipInfoResult
+	restrictionsGeoIP ipInfoResult
+	allowCIDR         string
+	denyCIDR          string
+	allowPrivateIP    bool
+	geo               *geoProviderChain
+	duo               *duoGate
+	duoUsers          *duoUsers
+	requireIdentity   bool
+	identityAllow     []string
+	identitySkip      string
+}
+
+// how a client identity that is in the allow list changes the other checks
+const (
+	identitySkipNone = "none"
+	identitySkipGeo  = "geo"
+	identitySkipAll  = "all"
+)
+
+// clientIdentity is who a client authenticated as
+type clientIdentity struct {
+	source string
+	name   string
+	names  []string
+}
+
+func (id *clientIdentity) String() string {
+	if id == nil {
+		return "identity: (none)"
+	}
+	return fmt.Sprintf("identity: %s %s", id.source, id.name)
+}
+
+// suffix is appended to the ESTABLISHED line when the client has an identity
+func (id *clientIdentity) suffix() string {
+	if id == nil {
+		return ""
+	}
+	return "; " + id.String()
+}
+
+// allowed returns true when the identity's name or one of its alternative names is in the allow list
+func (id *clientIdentity) allowed(allow []string) bool {
+	for _, name := range append([]string{id.name}, id.names...) {
+		for _, a := range allow {
+			if name == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// admissionQueue bounds the number of connections being vetted at the same time
+// as well as the number of connections waiting for a free admission worker
+type admissionQueue struct {
+	workers chan struct{}
+	waiting chan struct{}
+}
+
+func newAdmissionQueue(workers int, waiting int) *admissionQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if waiting < 0 {
+		waiting = 0
+	}
+	return &admissionQueue{
+		workers: make(chan struct{}, workers),
+		waiting: make(chan struct{}, workers+waiting),
+	}
+}
+
+/*
+admit waits for a free admission worker and then runs admit in the calling goroutine; the worker
+is only held for the admission checks, not for whatever the caller does before or after them, nor
+while waiting for a Duo push to be answered
+
+Returns:
+
+	the same as admit; queue_full when too many connections are already waiting for admission
+*/
+func (q *admissionQueue) admit(remote net.Addr, identity *clientIdentity, policy *admissionPolicy) (string, bool) {
+	select {
+	case q.waiting <- struct{}{}:
+	default:
+		logger.Warnf("[%v] DENIED; too many connections waiting for admission", remote)
+		return denied(policy, "queue_full")
+	}
+
+	q.workers <- struct{}{}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			<-q.workers
+			<-q.waiting
+		})
+	}
+	defer release()
+	return admit(remote, identity, policy, release)
+}
+
+// duoGate serializes Duo pushes for a single user and remembers the last successful authentication
+type duoGate struct {
+	mu        sync.Mutex
+	cred      duoCredentials
+	cacheTime int64
+	timeout   time.Duration
+	push      *duoPush
+}
+
+// duoPush is the outstanding push of a duoGate; done is closed once it has been answered
+type duoPush struct {
+	remoteIP string
+	done     chan struct{}
+	err      error
+}
+
+func newDuoGate(duoCred duoCredentials, cacheTime int64, timeout time.Duration) *duoGate {
+	return &duoGate{cred: duoCred, cacheTime: cacheTime, timeout: timeout}
+}
+
+// duoUsers creates a duoGate for each Duo user name that is taken from a client identity
+type duoUsers struct {
+	mu        sync.Mutex
+	file      string
+	cacheTime int64
+	timeout   time.Duration
+	gates     map[string]*duoGate
+}
+
+func newDuoUsers(file string, cacheTime int64, timeout time.Duration) *duoUsers {
+	return &duoUsers{file: file, cacheTime: cacheTime, timeout: timeout, gates: make(map[string]*duoGate)}
+}
+
+// get returns the gate of a user, reading the user's section of the Duo config file the first time it is needed
+func (u *duoUsers) get(name string) (*duoGate, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if gate, found := u.gates[name]; found {
+		return gate, nil
+	}
+	duoCred, err := duoReadConfig(u.file, name)
+	if err != nil {
+		return nil, err
+	}
+	gate := newDuoGate(duoCred, u.cacheTime, u.timeout)
+	u.gates[name] = gate
+	return gate, nil
+}
+
+/*
+authorize sends a Duo push unless the user recently authenticated from remoteIP
+
+Only one push per user is outstanding at any time. Connections from the same address that
+arrive while a push is pending share its outcome; connections from other addresses wait
+for it and then check again. The gate's mutex is not held while waiting.
+
+Args:
+
+	listener: the rule name, for metrics
+
+	remoteIP: the client address
+
+Returns:
+
+	true when the cached authentication, or the outcome of another connection's push, was
+	used; an error when Duo did not allow the connection
+*/
+func (g *duoGate) authorize(listener string, remoteIP string) (bool, error) {
+	g.mu.Lock()
+	for {
+		lastAuthTime := "(never)"
+		if g.cred.lastAuthTime > 0 {
+			lastAuthTime = fmt.Sprintf("%v", time.Unix(g.cred.lastAuthTime, 0))
+		}
+		logger.Infof("[%s] last auth time: %v", g.cred.name, lastAuthTime)
+
+		diff := time.Now().Unix() - g.cred.lastAuthTime
+		if diff <= g.cacheTime && g.cred.lastIP == remoteIP {
+			g.mu.Unlock()
+			logger.Infof("[%s] last auth time was only %v seconds ago, will not ask again", g.cred.name, diff)
+			return true, nil
+		}
+		if g.push == nil {
+			break
+		}
+
+		push := g.push
+		g.mu.Unlock()
+		logger.Infof("[%s] waiting for the Duo push to %s to be answered", g.cred.name, push.remoteIP)
+		<-push.done
+		if push.remoteIP == remoteIP {
+			return true, push.err
+		}
+		g.mu.Lock()
+	}
+
+	push := &duoPush{remoteIP: remoteIP, done: make(chan struct{})}
+	g.push = push
+	cred := g.cred
+	g.mu.Unlock()
+
+	start := time.Now()
+	allowed, err := duoCheckWithTimeout(cred, g.timeout)
+	if err == nil && !allowed {
+		err = errors.New("Duo Auth returned false")
+	}
+	result := "allow"
+	if err != nil {
+		result = "deny"
+	}
+	metricDuoLatency.WithLabelValues(listener, result).Observe(time.Since(start).Seconds())
+
+	g.mu.Lock()
+	if err == nil {
+		g.cred.lastAuthTime = time.Now().Unix()
+		g.cred.lastIP = remoteIP
+	}
+	g.push = nil
+	push.err = err
+	g.mu.Unlock()
+	close(push.done)
+	return false, err
+}
+
+// duoCheckWithTimeout gives up waiting on a Duo push after timeout; the push itself is left to expire on its own
+func duoCheckWithTimeout(duoCred duoCredentials, timeout time.Duration) (bool, error) {
+	if timeout <= 0 {
+		return duoCheck(duoCred)
+	}
+
+	type duoResult struct {
+		allowed bool
+		err     error
+	}
+	done := make(chan duoResult, 1)
+	go func() {
+		allowed, err := duoCheck(duoCred)
+		done <- duoResult{allowed, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.allowed, result.err
+	case <-time.After(timeout):
+		return false, fmt.Errorf("Error #240: Duo Auth timed out after %v", timeout)
+	}
+}
+
+/*
+admit runs the identity, CIDR, GeoIP and Duo checks for a newly accepted connection
+
+Args:
+
+	remote: the address of the incoming connection or UDP client
+
+	identity: who the client authenticated as, eg: with a client certificate; nil when unknown
+
+	policy: the restrictions to enforce
+
+	release: frees the admission worker; called before waiting for a Duo push
+
+Returns:
+
+	the admission path (allow_cidr, geo, identity, unix, duo, duo_cached) or the reason for the denial,
+	and true if the connection should be forwarded
+*/
+func admit(remote net.Addr, identity *clientIdentity, policy *admissionPolicy, release func()) (string, bool) {
+	remoteIP := addrIP(remote)
+	logger.Infof("[%v] Incoming connection initiated; rule: %s", remoteIP, policy.name)
+
+	if policy.requireIdentity || len(policy.identityAllow) > 0 {
+		if identity == nil {
+			logger.Warnf("[%v] DENIED; no client identity", remote)
+			return denied(policy, "identity_denied")
+		}
+		if len(policy.identityAllow) > 0 && !identity.allowed(policy.identityAllow) {
+			logger.Warnf("[%v] DENIED; %s is not allowed", remote, identity)
+			return denied(policy, "identity_denied")
+		}
+		switch policy.identitySkip {
+		case identitySkipAll:
+			logger.Infof("[%v] ESTABLISHED; %s", remote, identity)
+			return accepted(policy, "identity")
+		case identitySkipGeo:
+			return admitDuo(remote, identity, policy, release, "identity", "", "")
+		}
+	}
+
+	if "unix" == remote.Network() {
+		logger.Infof("[%v] Unix socket client, skipping CIDR and geo-ip checks", remote)
+		return admitDuo(remote, identity, policy, release, "unix", "", "")
+	}
+
+	// the CIDR lists are checked before the geo-ip lookup, so that an allowed address does not have to be in the geo-ip database
+	if len(policy.denyCIDR) > 0 && ipIsInCIDR(remoteIP, &policy.denyCIDR) {
+		logger.Infof("[%v] DENIED; Explicitly Denied by -D option", remote)
+		return denied(policy, "deny_cidr")
+	}
+
+	if len(policy.allowCIDR) > 0 && ipIsInCIDR(remoteIP, &policy.allowCIDR) {
+		logger.Infof("[%v] ESTABLISHED; Explicitly Allowed by -A option%s", remote, identity.suffix())
+		return accepted(policy, "allow_cidr")
+	}
+
+	geo, err := policy.geo.Lookup(remoteIP)
+	remoteGeoIP := geo.result
+	if !isLoopback(remoteIP) {
+		if policy.allowPrivateIP && isPrivateIP(remoteIP) {
+			logger.Infof("[%v] allowing private address, skip lat,lon checks", remoteIP)
+			err = nil
+		}
+		if err != nil {
+			logger.Warnf("[%v] DENIED; %s; %s", remote, err, geo)
+			return denied(policy, "geo_error")
+		}
+	}
+
+	invalidLocation, distanceCalc := validateLocation(policy.localGeoIP, remoteGeoIP, policy.restrictionsGeoIP)
+	if !isLoopback(remoteIP) {
+		if policy.allowPrivateIP && isPrivateIP(remoteIP) {
+			logger.Infof("[%v] allowing private address, skip loc,dist checks", remoteIP)
+			invalidLocation = ""
+		}
+		if len(invalidLocation) > 0 {
+			logger.Warnf("%s %s; %s", invalidLocation, distanceCalc, geo)
+			if policy.restrictionsGeoIP.Distance > 0 {
+				return denied(policy, "distance")
+			}
+			return denied(policy, "geo_mismatch")
+		}
+	}
+
+	return admitDuo(remote, identity, policy, release, "geo", distanceCalc, geo.String())
+}
+
+// admitDuo runs the Duo check, if any, as the last step of admit
+func admitDuo(remote net.Addr, identity *clientIdentity, policy *admissionPolicy, release func(), path string, distanceCalc string, geo string) (string, bool) {
+	gate := policy.duo
+	if policy.duoUsers != nil && identity != nil {
+		var err error
+		if gate, err = policy.duoUsers.get(identity.name); err != nil {
+			logger.Warnf("[%v] DENIED; no Duo user for %s: %s", remote, identity, err)
+			return denied(policy, "duo_denied")
+		}
+	}
+
+	if gate != nil {
+		// a push can take up to --duo-timeout; other connections should not wait for a worker meanwhile
+		release()
+		cached, err := gate.authorize(policy.name, addrIP(remote))
+		if err != nil {
+			errHandler(err, false)
+			logger.Warnf("[%v] DENIED; Duo Auth for user: %s; %s", remote, gate.cred.name, geo)
+			return denied(policy, "duo_denied")
+		}
+		path = "duo"
+		cachedDuoAuth := ""
+		if cached {
+			path = "duo_cached"
+			cachedDuoAuth = " CACHED"
+		}
+		logger.Infof("[%v] ACCEPTED%s; Duo Auth for user: %s", remote, cachedDuoAuth, gate.cred.name)
+	}
+
+	if 0 == len(geo) {
+		logger.Infof("[%v] ESTABLISHED; %s", remote, identity)
+	} else {
+		logger.Infof("[%v] ESTABLISHED; %s; %s%s", remote, distanceCalc, geo, identity.suffix())
+	}
+	return accepted(policy, path)
+}
+
+func accepted(policy *admissionPolicy, path string) (string, bool) {
+	metricAccepted.WithLabelValues(policy.name, path).Inc()
+	return path, true
+}
+
+func denied(policy *admissionPolicy, reason string) (string, bool) {
+	metricDenied.WithLabelValues(policy.name, reason).Inc()
+	return reason, false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAdmitCIDRBeforeGeoIP(t *testing.T) {
+	reader, err := openMMDB(writeTestMMDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.db.Close()
+	geo := &geoProviderChain{providers: []GeoProvider{reader}}
+
+	tests := []struct {
+		name      string
+		ip        string
+		allowCIDR string
+		denyCIDR  string
+		wantPath  string
+		wantOK    bool
+	}{
+		{"allowed, not in the database", "10.1.2.3", "10.0.0.0/8", "", "allow_cidr", true},
+		{"allowed IPv6, not in the database", "2001:db9::1", "2001:db9::/32", "", "allow_cidr", true},
+		{"denied before allowed", "10.1.2.3", "10.0.0.0/8", "10.1.0.0/16", "deny_cidr", false},
+		{"denied, in the database", "192.0.2.10", "", "192.0.2.0/24", "deny_cidr", false},
+		{"not allowed, not in the database", "203.0.113.5", "10.0.0.0/8", "", "geo_error", false},
+		{"not allowed, in the database", "192.0.2.10", "10.0.0.0/8", "", "geo", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &admissionPolicy{
+				name:              "test",
+				allowCIDR:         tt.allowCIDR,
+				denyCIDR:          tt.denyCIDR,
+				geo:               geo,
+				restrictionsGeoIP: ipInfoResult{Country: "US"},
+			}
+			remote := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 40000}
+			path, ok := admit(remote, nil, policy, func() {})
+			if path != tt.wantPath || ok != tt.wantOK {
+				t.Errorf("admit(%s) = %s, %v; want %s, %v", tt.ip, path, ok, tt.wantPath, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+/*
+backends.go
+
+A rule can forward to several upstream targets: --to takes a comma delimited list.
+The backend for a new connection is picked with --balance; when dialing it fails,
+the next one is tried. A backend that fails --backend-max-fails times in a row is
+marked down and skipped for --backend-cooldown seconds. See also health.go
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balanceRoundRobin = "roundrobin"
+	balanceLeastConn  = "leastconn"
+	balanceHash       = "hash"
+)
+
+// backend is one upstream target of a rule
+type backend struct {
+	address   string
+	active    atomic.Int32
+	unhealthy atomic.Bool
+
+	// protected by backendPool.mu
+	failures  int
+	downUntil time.Time
+}
+
+// release is called when a connection to this backend has ended
+func (b *backend) release() {
+	b.active.Add(-1)
+}
+
+type backendPool struct {
+	mu       sync.Mutex
+	name     string
+	proto    string
+	mode     string
+	backends []*backend
+	next     int
+	maxFails int
+	cooldown time.Duration
+
+	check      healthCheck
+	stopHealth chan struct{}
+	stopOnce   sync.Once
+}
+
+// splitBackends returns the addresses of a comma delimited --to value
+func splitBackends(to string) []string {
+	var addresses []string
+	for _, address := range strings.Split(to, ",") {
+		if address = strings.TrimSpace(address); len(address) > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+func newBackendPool(name string, proto string, to string, mode string, maxFails int, cooldown time.Duration, check healthCheck) *backendPool {
+	pool := &backendPool{
+		name:       name,
+		proto:      proto,
+		mode:       mode,
+		maxFails:   maxFails,
+		cooldown:   cooldown,
+		check:      check,
+		stopHealth: make(chan struct{}),
+	}
+	for _, address := range splitBackends(to) {
+		pool.backends = append(pool.backends, &backend{address: address})
+	}
+	return pool
+}
+
+/*
+candidates returns the backends in the order in which they should be tried
+
+Backends that are marked down or that failed their last health check are moved to the
+end, so they are only used when every other backend has failed as well. With source-IP
+hashing, a client always starts with the same backend for as long as that backend is up.
+
+Args:
+
+	clientIP: the address of the client, used for hashing
+
+Returns:
+
+	every backend, the preferred one first
+*/
+func (p *backendPool) candidates(clientIP string) []*backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.backends)
+	start := 0
+	switch p.mode {
+	case balanceRoundRobin:
+		start = p.next % n
+		p.next++
+	case balanceHash:
+		h := fnv.New32a()
+		h.Write([]byte(clientIP))
+		start = int(h.Sum32() % uint32(n))
+	}
+
+	ordered := make([]*backend, 0, n)
+	for i := 0; i < n; i++ {
+		ordered = append(ordered, p.backends[(start+i)%n])
+	}
+	if balanceLeastConn == p.mode {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].active.Load() < ordered[j].active.Load()
+		})
+	}
+
+	now := time.Now()
+	usable := func(b *backend) bool {
+		return !now.Before(b.downUntil) && !b.unhealthy.Load()
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return usable(ordered[i]) && !usable(ordered[j])
+	})
+	return ordered
+}
+
+// failed records a failed dial and marks the backend down once it has failed too many times in a row
+func (p *backendPool) failed(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.failures++
+	logger.Warnf("[%s] backend %s failed (%d in a row): %s", p.name, b.address, b.failures, err)
+	if b.failures >= p.maxFails && !time.Now().Before(b.downUntil) {
+		b.downUntil = time.Now().Add(p.cooldown)
+		logger.Warnf("[%s] backend %s marked down for %v", p.name, b.address, p.cooldown)
+	}
+}
+
+// succeeded resets the failure count of a backend
+func (p *backendPool) succeeded(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b.failures >= p.maxFails {
+		logger.Infof("[%s] backend %s is up again", p.name, b.address)
+	}
+	b.failures = 0
+	b.downUntil = time.Time{}
+}
+
+/*
+dial connects to the first backend that accepts the connection
+
+Args:
+
+	clientIP: the address of the client, used for source-IP hashing
+
+	dialer: opens a connection to the given backend address
+
+Returns:
+
+	the connection and its backend, which must be released when the connection ends,
+	or an error when every backend failed
+*/
+func (p *backendPool) dial(clientIP string, dialer func(address string) (net.Conn, error)) (net.Conn, *backend, error) {
+	var lastErr error
+	for _, b := range p.candidates(clientIP) {
+		conn, err := dialer(b.address)
+		if err != nil {
+			p.failed(b, err)
+			lastErr = err
+			continue
+		}
+		p.succeeded(b)
+		b.active.Add(1)
+		return conn, b, nil
+	}
+	return nil, nil, fmt.Errorf("[%s] all backends failed; last error: %v", p.name, lastErr)
+}
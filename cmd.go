@@ -20,6 +20,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -32,9 +33,33 @@ import (
 const version = "0.7.3"
 
 var (
-	list        = kingpin.Flag("int", "list local interface IP addresses").Short('i').Bool()
-	from        = kingpin.Flag("from", "from address:port - use '0.0.0.0' for all interfaces; use '_eth0' for the address portion to use this interface; also '_en0', '_Ethernet', etc.").Short('f').String()
-	to          = kingpin.Flag("to", "to address:port - address portion can also be DNS name").Short('t').String()
+	listNICs    = kingpin.Flag("int", "list local interface IP addresses").Short('i').Bool()
+	from        = kingpin.Flag("from", "from address:port - use '0.0.0.0' for all interfaces, '[::]' for all IPv6 interfaces; use '_eth0' for the address portion to use this interface, '_eth0/6' for its IPv6 address; also '_en0', '_Ethernet', etc.; a port range such as 0.0.0.0:30000-30100; or unix:/path.sock").Short('f').String()
+	proto       = kingpin.Flag("proto", "protocol to forward: tcp or udp").Default("tcp").Enum("tcp", "udp")
+	to          = kingpin.Flag("to", "to address:port - address portion can also be DNS name; IPv6 addresses must be in brackets: [2001:db8::1]:22; use a comma delimited list for multiple backends; a port range of the same size as --from, or a single port for all of them; or unix:/path.sock").Short('t').String()
+	acceptProxy = kingpin.Flag("accept-proxy", "comma delimited list of CIDR networks, eg: a load balancer, that must send a PROXY protocol v1/v2 header with the real client address").String()
+	sendProxy   = kingpin.Flag("send-proxy", "send a PROXY protocol header with the client address to the --to backend: v1 or v2").Enum("v1", "v2")
+	sni         = kingpin.Flag("sni", "only forward TLS connections for this server name, without decrypting them; also *.example.com; see --config to route several names").String()
+	tlsCert     = kingpin.Flag("tls-cert", "accept TLS connections with this PEM certificate (chain) file and forward the decrypted stream; use with --tls-key").String()
+	tlsKey      = kingpin.Flag("tls-key", "PEM private key file for --tls-cert").String()
+	tlsMin      = kingpin.Flag("tls-min-version", "minimum TLS version accepted from clients: 1.0, 1.1, 1.2, 1.3").Default("1.2").Enum("1.0", "1.1", "1.2", "1.3")
+	tlsClientCA = kingpin.Flag("tls-client-ca", "require a client certificate signed by a CA in this PEM file; use with --tls-cert").String()
+	tlsAllow    = kingpin.Flag("tls-client-allow", "comma delimited list of client certificate names (CN or SAN) that are allowed to connect").String()
+	tlsSkip     = kingpin.Flag("tls-client-skip", "checks that an allowed client certificate replaces: none, geo (CIDR and geo-ip), all (CIDR, geo-ip and Duo)").Default("none").Enum("none", "geo", "all")
+	toTLS       = kingpin.Flag("to-tls", "connect to the --to backend with TLS").Bool()
+	toTLSSNI    = kingpin.Flag("to-tls-sni", "server name to send to and verify for the TLS backend; defaults to the --to host name").String()
+	toTLSCA     = kingpin.Flag("to-tls-ca", "PEM file of CAs to verify the TLS backend with, instead of the system CAs").String()
+	toTLSCert   = kingpin.Flag("to-tls-cert", "PEM client certificate to present to the TLS backend; use with --to-tls-key").String()
+	toTLSKey    = kingpin.Flag("to-tls-key", "PEM private key file for --to-tls-cert").String()
+	toTLSVerify = kingpin.Flag("to-tls-verify", "how to verify the TLS backend: full, ca-only (skip the host name check), none").Default("full").Enum("full", "ca-only", "none")
+	toSource    = kingpin.Flag("to-source", "local address to connect to the --to backends from; use '_eth0' for the address of this interface, '_eth0/6' for its IPv6 address").String()
+	socks5      = kingpin.Flag("socks5", "act as a SOCKS5 proxy where the client picks the destination, instead of forwarding to --to; use with --proxy-allow").Bool()
+	httpConnect = kingpin.Flag("http-connect", "act as an HTTP CONNECT proxy where the client picks the destination, instead of forwarding to --to; use with --proxy-allow").Bool()
+	proxyAllow  = kingpin.Flag("proxy-allow", "comma delimited list of destinations a --socks5 / --http-connect client may connect to: CIDR networks, host names or *.example.com, each with an optional :port or :port-port").String()
+	proxyUsers  = kingpin.Flag("proxy-users", "ini file with a section per --socks5 / --http-connect user name and its password key; clients must log in").String()
+	unixMode    = kingpin.Flag("unix-mode", "permissions of the socket file when --from is unix:/path.sock").Default("0660").String()
+	balance     = kingpin.Flag("balance", "how to pick one of multiple --to backends: roundrobin, leastconn, hash (of the client IP address)").Default("roundrobin").Enum("roundrobin", "leastconn", "hash")
+	configFile  = kingpin.Flag("config", "ini file with one forwarding rule per section; rules are added to the one given with --from, --to (see gofwd-example.ini)").Short('c').String()
 	examples    = kingpin.Flag("examples", "show command line example and then exit").Bool()
 	versionOnly = kingpin.Flag("version", "show version and then exit").Bool()
 
@@ -47,12 +72,49 @@ var (
 	denyCIDR  = kingpin.Flag("deny", "deny from a comma delimited list of CIDR networks, disregarding geo-ip, duo").Short('D').String()
 
 	duo              = kingpin.Flag("duo", "path to duo ini config file and duo username; format: filename:user (see --examples)").String()
+	duoIdentity      = kingpin.Flag("duo-identity-user", "use the client certificate name (CN) or the --proxy-users name as the Duo user name instead of the user given with --duo").Bool()
 	duoAuthCacheTime = kingpin.Flag("duo-cache-time", "number of seconds to cache a successful Duo authentication (default is 120)").Default("120").Int64()
-	private          = kingpin.Flag("private", "allow RFC1918 private addresses for the incoming (connecting) IP").Short('p').Bool()
+	private          = kingpin.Flag("private", "allow RFC1918 private addresses, IPv6 unique local and link-local addresses for the incoming (connecting) IP").Short('p').Bool()
+
+	admitWorkers  = kingpin.Flag("admit-workers", "maximum number of incoming connections vetted (CIDR, geo-ip) at the same time; connections waiting for a Duo push do not count").Default("16").Int()
+	admitQueue    = kingpin.Flag("admit-queue", "maximum number of incoming connections waiting for an admission worker; others are dropped").Default("64").Int()
+	geoIPTimeout  = kingpin.Flag("geoip-timeout", "number of seconds to wait for a geo-ip lookup").Default("10").Int64()
+	duoTimeout    = kingpin.Flag("duo-timeout", "number of seconds to wait for a Duo push to be answered").Default("60").Int64()
+	metricsListen = kingpin.Flag("metrics-listen", "address:port to serve Prometheus metrics on, at /metrics").String()
+	drainTimeout  = kingpin.Flag("drain-timeout", "number of seconds to wait for forwarded connections to finish on SIGINT / SIGTERM before closing them").Default("30").Int64()
+	udpTimeout    = kingpin.Flag("udp-timeout", "number of seconds after which an idle UDP session is removed").Default("60").Int64()
+	dialTimeout   = kingpin.Flag("dial-timeout", "number of seconds to wait for a connection to a --to backend").Default("10").Int64()
+	dialRetries   = kingpin.Flag("dial-retries", "number of times to retry when every --to backend failed").Default("0").Int()
+	dialBackoff   = kingpin.Flag("dial-backoff", "number of milliseconds to wait before the first retry; doubled for each further retry").Default("250").Int64()
+	keepAlive     = kingpin.Flag("keepalive", "number of seconds between TCP keepalive probes on both the client and the backend connection; 0 to disable").Default("15").Int64()
+	backendFails  = kingpin.Flag("backend-max-fails", "number of failed connections in a row after which a backend is marked down").Default("3").Int()
+	backendCool   = kingpin.Flag("backend-cooldown", "number of seconds a backend that is marked down is skipped").Default("30").Int64()
+	healthEvery   = kingpin.Flag("health-interval", "number of seconds between health checks of the --to backends; 0 to disable").Default("0").Int64()
+	healthTimeout = kingpin.Flag("health-timeout", "number of seconds to wait for a health check to connect and reply").Default("5").Int64()
+	healthSend    = kingpin.Flag("health-send", "send this to a backend during a health check, eg: 'PING\\r\\n'").String()
+	healthExpect  = kingpin.Flag("health-expect", "a backend is only healthy when its reply contains this, eg: 'SSH-2.0'").String()
+	idleTimeout   = kingpin.Flag("idle-timeout", "close a TCP connection after this many seconds without any data in either direction; 0 to disable").Default("0").Int64()
+	maxSession    = kingpin.Flag("max-session", "close a TCP connection after this many seconds, regardless of activity; 0 to disable").Default("0").Int64()
+	geoIPDBFile   = kingpin.Flag("geoip-db", "path to a GeoLite2-City / DB-IP .mmdb file; used for offline geo-ip lookups instead of ipinfo.io").String()
+	geoIPCSV      = kingpin.Flag("geoip-csv", "path to an IP2Location LITE .csv file; used for offline geo-ip lookups instead of ipinfo.io").String()
+	geoIPStatic   = kingpin.Flag("geoip-static", "path to an ini file of CIDR networks with fixed geo-ip values, checked before any other provider").String()
+	geoIPChain    = kingpin.Flag("geoip-chain", "comma delimited, ordered list of geo-ip providers to try: ipinfo, mmdb, ip2location, static").String()
+	ipInfoToken   = kingpin.Flag("ipinfo-token", "ipinfo.io API token").Envar("IPINFO_TOKEN").String()
+
+	geoCacheSize        = kingpin.Flag("geoip-cache-size", "maximum number of geo-ip lookups to cache; use 0 to disable the cache").Default("4096").Int()
+	geoCacheTTL         = kingpin.Flag("geoip-cache-ttl", "number of seconds to cache a successful geo-ip lookup").Default("3600").Int64()
+	geoCacheNegativeTTL = kingpin.Flag("geoip-cache-negative-ttl", "number of seconds to cache a failed geo-ip lookup").Default("60").Int64()
+	geoCacheFile        = kingpin.Flag("geoip-cache-file", "save the geo-ip cache to this file so that it survives restarts").String()
 )
 
 var logger *zap.SugaredLogger
 
+// exitHooks are run by signalHandler before the process exits
+var exitHooks []func()
+
+// reloadHooks are run by signalHandler on SIGHUP
+var reloadHooks []func()
+
 func errHandler(err error, fatal bool) {
 	if err != nil {
 		logger.Warnf(err.Error())
@@ -64,11 +126,21 @@ func errHandler(err error, fatal bool) {
 
 func signalHandler() {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		sig := <-sigs
-		logger.Errorf("Execution stopped by %s", sig)
-		os.Exit(0)
+		for sig := range sigs {
+			if syscall.SIGHUP == sig {
+				for _, hook := range reloadHooks {
+					hook()
+				}
+				continue
+			}
+			logger.Errorf("Execution stopped by %s", sig)
+			for _, hook := range exitHooks {
+				hook()
+			}
+			os.Exit(0)
+		}
 	}()
 }
 
@@ -108,22 +180,160 @@ func isPrivateIPv4(s string) bool {
 	return false
 }
 
-func fwd(src net.Conn, remote string, proto string) {
-	dst, err := net.Dial(proto, remote)
+// isPrivateIP returns true for RFC1918 IPv4 addresses as well as IPv6 unique local (fc00::/7) and link-local (fe80::/10) addresses
+func isPrivateIP(s string) bool {
+	if isPrivateIPv4(s) {
+		return true
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return false
+	}
+	return ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// isLoopback returns true for 127.0.0.0/8 and ::1
+func isLoopback(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.IsLoopback()
+}
+
+// addrIP returns the IP portion of addr without the port, brackets or IPv6 zone
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func fwd(src net.Conn, rule *forwardRule, path string) {
+	listener := rule.name
+	dst, upstream, err := rule.dialBackend(addrIP(src.RemoteAddr()))
+	if err == nil && len(rule.sendProxy) > 0 {
+		if err = writeProxyHeader(dst, rule.sendProxy, src); err != nil {
+			dst.Close()
+			upstream.release()
+		}
+	}
 	errHandler(err, false)
 	if err != nil {
+		metricDenied.WithLabelValues(listener, "upstream_error").Inc()
+		src.Close()
 		return
 	}
+
+	session := newForwardSession(src, dst, listener, path)
+	if rule.upstreamTLS != nil {
+		tlsConn, err := upstreamHandshake(dst, rule.upstreamTLS, upstream.address)
+		if err != nil {
+			errHandler(err, false)
+			metricDenied.WithLabelValues(listener, "upstream_tls_error").Inc()
+			session.setCloseReason(closeUpstreamTLS)
+			session.close()
+			session.logSummary()
+			upstream.release()
+			return
+		}
+		session.dst = tlsConn
+	}
+	forward(session, rule, upstream.release)
+}
+
+/*
+forward relays a session in both directions until it ends
+
+Args:
+
+	session: the client and upstream connections, already connected
+
+	rule: the rule the session was admitted by
+
+	release: called once the session has ended
+*/
+func forward(session *forwardSession, rule *forwardRule, release func()) {
+	listener := rule.name
+	src, dst := session.src, session.dst
+	if !activeSessions.add(session) {
+		logger.Infof("[%v] DENIED; shutting down", src.RemoteAddr())
+		metricDenied.WithLabelValues(listener, "shutdown").Inc()
+		session.close()
+		release()
+		return
+	}
+	metricActiveSessions.WithLabelValues(listener).Inc()
+
+	done := make(chan struct{})
+	if rule.idleTimeout > 0 || rule.maxSession > 0 {
+		go session.watch(rule.idleTimeout, rule.maxSession, done)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
-		_, err = io.Copy(src, dst)
-		errHandler(err, false)
+		defer wg.Done()
+		relay(session, src, meteredReader{dst, metricBytes.WithLabelValues(listener, "out"), &session.bytesOut}, closeUpstreamEOF)
 	}()
 	go func() {
-		_, err = io.Copy(dst, src)
-		errHandler(err, false)
+		defer wg.Done()
+		relay(session, dst, meteredReader{src, metricBytes.WithLabelValues(listener, "in"), &session.bytesIn}, closeClientEOF)
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+		session.close()
+		release()
+		session.logSummary()
+		metricActiveSessions.WithLabelValues(listener).Dec()
+		activeSessions.remove(session)
 	}()
 }
 
+/*
+relay copies one direction of a session
+
+When the reader reaches EOF, the write side of dst is closed so that the peer sees the
+EOF as well while the other direction keeps running. Any other error tears down the
+whole session, which also ends the other direction.
+
+Args:
+
+	session: the session this direction belongs to
+
+	dst: the connection to write to
+
+	src: the connection to read from
+
+	eofReason: the close reason recorded when src reaches EOF first
+*/
+func relay(session *forwardSession, dst net.Conn, src io.Reader, eofReason string) {
+	_, err := io.Copy(dst, src)
+	if err == nil {
+		session.setCloseReason(eofReason)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			if err = cw.CloseWrite(); err == nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+		} else {
+			session.close()
+			return
+		}
+	}
+
+	if !errors.Is(err, net.ErrClosed) {
+		errHandler(err, false)
+	}
+	session.setCloseReason(closeError)
+	session.close()
+}
+
 func validateCIDRList(all *string) (string, bool) {
 	networks := strings.Split(*all, ",")
 	for _, cidr := range networks {
@@ -139,109 +349,123 @@ func ipIsInCIDR(s string, cidr *string) bool {
 	ip := net.ParseIP(s)
 	networks := strings.Split(*cidr, ",")
 	for _, cidr := range networks {
-		_, ipv4Net, err := net.ParseCIDR(cidr)
+		_, ipNet, err := net.ParseCIDR(cidr)
 		if err != nil {
 			logger.Warnf("Invalid CIDR network: %s", err)
 			return false
 		}
-		if ipv4Net.Contains(ip) {
+		if ipNet.Contains(ip) {
 			return true
 		}
 	}
 	return false
 }
 
-func tcpStart(from string, to string, localGeoIP ipInfoResult, restrictionsGeoIP ipInfoResult, duoCred duoCredentials, duoAuthCacheTime int64, allowPrivateIP bool) {
-	proto := "tcp"
-
-	fromAddress, err := net.ResolveTCPAddr(proto, from)
-	errHandler(err, true)
-
-	toAddress, err := net.ResolveTCPAddr(proto, to)
-	errHandler(err, true)
-
-	listener, err := net.ListenTCP(proto, fromAddress)
-	errHandler(err, true)
+func tcpStart(listener net.Listener, rl *ruleListener, queue *admissionQueue) {
 	defer listener.Close()
 
-	logger.Infof("[%v] Forwarding to [%s] [%s]", fromAddress, proto, toAddress)
 	for {
 		src, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		errHandler(err, true)
-
-		slots := strings.Split(src.RemoteAddr().String(), ":")
-		remoteIP := slots[0]
-		logger.Infof("[%v] Incoming connection initiated", remoteIP)
-		remoteGeoIP, err := getIPInfo(remoteIP)
-		if "127.0.0.1" != remoteIP {
-			if allowPrivateIP && isPrivateIPv4(remoteIP) {
-				logger.Infof("[%v] allowing private IPv4 address, skip lat,lon checks", remoteIP)
-				err = nil
-			}
-			if err != nil {
-				logger.Warnf("%s", err)
-				continue
-			}
+		if unixConn, ok := src.(*net.UnixConn); ok {
+			src = unixClientConn{unixConn}
 		}
 
-		if len(*denyCIDR) > 0 && ipIsInCIDR(remoteIP, denyCIDR) {
-			logger.Infof("[%v] DENIED; Explicitly Denied by -D option", src.RemoteAddr())
+		// the rule may be replaced by a reload at any time; this connection keeps the one it was accepted with
+		rule := rl.rule.Load()
+		routes := rl.routes.Load()
+		setKeepAlive(src, rule.dial.keepAlive)
+		if routes == nil && rule.proxy == nil && !rule.backends.healthy() {
+			logger.Warnf("[%v] DENIED; no healthy backend for rule: %s", src.RemoteAddr(), rule.name)
+			metricDenied.WithLabelValues(rule.name, "unhealthy").Inc()
+			src.Close()
 			continue
 		}
+		go handleTCP(src, rule, routes, queue)
+	}
+}
 
-		if len(*allowCIDR) > 0 && ipIsInCIDR(remoteIP, allowCIDR) {
-			logger.Infof("[%v] ESTABLISHED; Explicitly Allowed by -A option", src.RemoteAddr())
-			go fwd(src, to, proto)
-			continue
+/*
+handleTCP runs in its own goroutine for each accepted TCP connection; whatever the client has to
+send before it can be vetted is read here, under its own deadline, so that an idle client does not
+hold an admission worker
+
+Args:
+
+	src: the client connection
+
+	rule: the rule of the listener
+
+	routes: when not nil, the rule is picked by the server name of the client's TLS ClientHello
+
+	queue: the admission workers
+*/
+func handleTCP(src net.Conn, rule *forwardRule, routes *sniRoutes, queue *admissionQueue) {
+	if len(rule.acceptProxy) > 0 && ipIsInCIDR(addrIP(src.RemoteAddr()), &rule.acceptProxy) {
+		proxied, err := readProxyHeader(src)
+		if err != nil {
+			logger.Warnf("[%v] DENIED; %s", src.RemoteAddr(), err)
+			metricDenied.WithLabelValues(rule.name, "proxy_error").Inc()
+			src.Close()
+			return
 		}
-		invalidLocation, distanceCalc := validateLocation(localGeoIP, remoteGeoIP, restrictionsGeoIP)
-		if "127.0.0.1" != remoteIP {
-			if allowPrivateIP && isPrivateIPv4(remoteIP) {
-				logger.Infof("[%v] allowing private IPv4 address, skip loc,dist checks", remoteIP)
-				invalidLocation = ""
-			}
-			if len(invalidLocation) > 0 {
-				logger.Warnf("%s %s", invalidLocation, distanceCalc)
-				// do not attempt: listener.Close()
-				continue
-			}
+		src = proxied
+	}
+	if rule.proxy != nil {
+		if proxySOCKS5 == rule.proxy.mode {
+			socksForward(src, rule, queue)
+		} else {
+			httpConnectForward(src, rule, queue)
 		}
-
-		if len(duoCred.name) > 0 {
-			var allowed bool
-			lastAuthTime := "(never)"
-			cachedDuoAuth := ""
-			if duoCred.lastAuthTime > 0 {
-				lastAuthTime = fmt.Sprintf("%v", time.Unix(duoCred.lastAuthTime, 0))
-			}
-			logger.Infof("[%s] last auth time: %v", duoCred.name, lastAuthTime)
-
-			current := time.Now().Unix()
-			diff := current - duoCred.lastAuthTime
-			if diff <= duoAuthCacheTime && duoCred.lastIP == remoteIP {
-				logger.Infof("[%s] last auth time was only %v seconds ago, will not ask again", duoCred.name, diff)
-				cachedDuoAuth = " CACHED"
-			} else {
-				allowed, err = duoCheck(duoCred)
-				if err != nil {
-					errHandler(err, false)
-					logger.Warnf("[%v] DENIED; Duo Auth for user: %s", src.RemoteAddr(), duoCred.name)
-					continue
-				}
-				if !allowed {
-					errHandler(errors.New("Duo Auth returned false"), false)
-					logger.Warnf("[%v] DENIED; Duo Auth for user: %s", src.RemoteAddr(), duoCred.name)
-					continue
-				}
-				duoCred.lastAuthTime = time.Now().Unix()
-				duoCred.lastIP = remoteIP
-			}
-			logger.Infof("[%v] ACCEPTED%s; Duo Auth for user: %s", src.RemoteAddr(), cachedDuoAuth, duoCred.name)
+		return
+	}
+	if routes != nil {
+		peeked, serverName, err := peekServerName(src)
+		if err != nil {
+			logger.Warnf("[%v] DENIED; %s", src.RemoteAddr(), err)
+			metricDenied.WithLabelValues(rule.name, "sni_error").Inc()
+			src.Close()
+			return
 		}
+		src = peeked
+		route := routes.match(serverName)
+		if route == nil {
+			logger.Warnf("[%v] DENIED; no rule for server name: %q", src.RemoteAddr(), serverName)
+			metricDenied.WithLabelValues(rule.name, "sni_unknown").Inc()
+			src.Close()
+			return
+		}
+		rule = route
+		logger.Infof("[%v] server name: %q; rule: %s", src.RemoteAddr(), serverName, rule.name)
+		if !rule.backends.healthy() {
+			logger.Warnf("[%v] DENIED; no healthy backend for rule: %s", src.RemoteAddr(), rule.name)
+			metricDenied.WithLabelValues(rule.name, "unhealthy").Inc()
+			src.Close()
+			return
+		}
+	}
+	var identity *clientIdentity
+	if rule.tlsConfig != nil {
+		tlsConn, err := tlsHandshake(src, rule.tlsConfig)
+		if err != nil {
+			logger.Warnf("[%v] DENIED; %s", src.RemoteAddr(), err)
+			metricDenied.WithLabelValues(rule.name, "tls_error").Inc()
+			src.Close()
+			return
+		}
+		src = tlsConn
+		identity = certIdentity(tlsConn)
+	}
 
-		logger.Infof("[%v] ESTABLISHED; %s", src.RemoteAddr(), distanceCalc)
-		go fwd(src, to, proto)
+	path, ok := queue.admit(src.RemoteAddr(), identity, rule.policy)
+	if !ok {
+		src.Close()
+		return
 	}
+	fwd(src, rule, path)
 }
 
 func showExamples() {
@@ -256,14 +480,22 @@ func showExamples() {
 	table.Render()
 }
 
-func getDuoConfig(duoFile string, duoUser string, duoAuthCacheTime int64) duoCredentials {
-	duoCred, err := duoReadConfig(duoFile, duoUser)
+// getLocalGeoIPOffline looks up the listening address with the offline geo-ip providers, since only ipinfo.io can find our own public address
+func getLocalGeoIPOffline(from string, geoProviders *geoProviderChain) ipInfoResult {
+	if _, ok := unixSocketPath(from); ok {
+		return ipInfoResult{}
+	}
+	host, _, err := net.SplitHostPort(from)
 	if err != nil {
-		errHandler(err, true)
-		os.Exit(1)
+		errHandler(err, false)
+		return ipInfoResult{}
+	}
+	geo, err := geoProviders.Lookup(host)
+	if err != nil {
+		logger.Infof("[%s] local address is not in the geo-ip database; --distance requires --loc", host)
+		return ipInfoResult{}
 	}
-	logger.Infof("Duo auth activated for user: %s; cache time: %v seconds", duoCred.name, duoAuthCacheTime)
-	return duoCred
+	return geo.result
 }
 
 func main() {
@@ -278,7 +510,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *list {
+	if *listNICs {
 		nics()
 		os.Exit(0)
 	}
@@ -288,94 +520,65 @@ func main() {
 		os.Exit(0)
 	}
 
-	if !(len(*from) >= 9 && len(*to) >= 9) {
-		kingpin.FatalUsage("Both --from and --to are mandatory")
-		os.Exit(1)
-	}
-
-	if *from == *to {
-		kingpin.FatalUsage("--from and --to can not be identical")
+	configs, err := loadRuleConfigs()
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
 		os.Exit(1)
 	}
 
-	if !strings.Contains(*from, ":") {
-		kingpin.FatalUsage("--from does not contain a ':' character")
-		os.Exit(1)
-	}
+	logger.Infof("gofwd, version %v started", version)
 
-	if !strings.Contains(*to, ":") {
-		kingpin.FatalUsage("--to does not contain a ':' character")
-		os.Exit(1)
-	}
+	ipInfoClient.Timeout = time.Duration(*geoIPTimeout) * time.Second
 
-	if strings.HasPrefix(*from, "_") {
-		pos := strings.Index(*from, ":")
-		adapter := (*from)[1:pos]
-		port := (*from)[pos+1:]
-		address, err := getSpecificNic(adapter)
-		if err != nil {
-			kingpin.FatalUsage(err.Error())
-		}
-		*from = address + ":" + port
-	}
-
-	if len(*loc) > 0 && 0 == *distance {
-		kingpin.FatalUsage("--distance must be used with --loc")
+	geoProviders, err := newGeoProviderChain(*geoIPChain, *ipInfoToken, *geoIPDBFile, *geoIPCSV, *geoIPStatic)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
 		os.Exit(1)
 	}
-
-	if *distance > 0 && (len(*city) > 0 || len(*region) > 0 || len(*country) > 0) {
-		kingpin.FatalUsage("--distance can not be used with any of these: city, region, country; Instead, use --loc with --distance")
-		os.Exit(1)
+	var providerNames []string
+	for _, provider := range geoProviders.providers {
+		providerNames = append(providerNames, provider.Name())
 	}
+	logger.Infof("Geo IP providers: %s", strings.Join(providerNames, ", "))
 
-	var badCIDR string
-	var ok bool
-	if len(*denyCIDR) > 0 {
-		badCIDR, ok = validateCIDRList(denyCIDR)
-		if !ok {
-			kingpin.FatalUsage("Invalid CIDR given for -D option: %s\n", badCIDR)
-			os.Exit(1)
+	if *geoCacheSize > 0 {
+		geoProviders.cache = newGeoCache(*geoCacheSize, time.Duration(*geoCacheTTL)*time.Second, time.Duration(*geoCacheNegativeTTL)*time.Second, *geoCacheFile)
+		if err := geoProviders.cache.load(); err != nil {
+			errHandler(err, false)
 		}
-	}
-
-	if len(*allowCIDR) > 0 {
-		badCIDR, ok = validateCIDRList(allowCIDR)
-		if !ok {
-			kingpin.FatalUsage("Invalid CIDR given for -A option: %s\n", badCIDR)
-			os.Exit(1)
+		if len(*geoCacheFile) > 0 {
+			go geoProviders.cache.saveEvery(time.Minute)
+			exitHooks = append(exitHooks, func() { errHandler(geoProviders.cache.save(), false) })
 		}
+		logger.Infof("Geo IP cache: %d entries; ttl: %v seconds; negative ttl: %v seconds", *geoCacheSize, *geoCacheTTL, *geoCacheNegativeTTL)
 	}
 
-	logger.Infof("gofwd, version %v started", version)
-	logger.Info("from: [%s]", *from)
-	logger.Info("  to: [%s]", *to)
-
-	var duoCred duoCredentials
-	if len(*duo) > 0 {
-		slots := strings.Split(*duo, ":")
-		if len(slots) != 2 {
-			kingpin.FatalUsage("Invalid duo filename / user combination")
+	var selfGeoIP *ipInfoResult
+	if geoProviders.usesIPInfo() {
+		localGeoIP, err := queryIPInfo("", *ipInfoToken)
+		if err != nil {
+			errHandler(err, true)
 			os.Exit(1)
 		}
-		duoCred = getDuoConfig(slots[0], slots[1], *duoAuthCacheTime)
+		selfGeoIP = &localGeoIP
 	}
 
-	var restrictionsGeoIP ipInfoResult
-	restrictionsGeoIP.City = *city
-	restrictionsGeoIP.Region = *region
-	restrictionsGeoIP.Country = *country
-	restrictionsGeoIP.Distance = *distance
-	restrictionsGeoIP.Loc = *loc
-	logger.Infof("Geo IP Restrictions: %v", restrictionsGeoIP)
-
-	var localGeoIP ipInfoResult
-	var err error
-	localGeoIP, err = getIPInfo("")
+	rules, err := buildRules(configs, geoProviders, selfGeoIP)
 	if err != nil {
-		errHandler(err, true)
+		kingpin.FatalUsage(err.Error())
 		os.Exit(1)
 	}
 
-	tcpStart(*from, *to, localGeoIP, restrictionsGeoIP, duoCred, *duoAuthCacheTime, *private)
+	if len(*metricsListen) > 0 {
+		go metricsStart(*metricsListen)
+	}
+
+	queue := newAdmissionQueue(*admitWorkers, *admitQueue)
+	fwdr := newForwarder(queue, geoProviders, selfGeoIP)
+	if err := fwdr.apply(rules); err != nil {
+		errHandler(err, true)
+	}
+	reloadHooks = append(reloadHooks, fwdr.reload)
+	exitHooks = append(exitHooks, func() { fwdr.shutdown(time.Duration(*drainTimeout) * time.Second) })
+	select {}
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// testForward connects a client and a backend over loopback and forwards between them
+type testForward struct {
+	client  *net.TCPConn // the test's client
+	backend *net.TCPConn // the test's backend, as accepted
+	session *forwardSession
+	done    chan struct{} // closed once the session has been released
+}
+
+// startTestForward runs forward between a loopback client and a loopback backend
+func startTestForward(t *testing.T) *testForward {
+	t.Helper()
+	accept := func(listener net.Listener) <-chan net.Conn {
+		conns := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(conns)
+				return
+			}
+			conns <- conn
+		}()
+		return conns
+	}
+	listen := func() net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		return listener
+	}
+	dial := func(address string) net.Conn {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	proxyListener, backendListener := listen(), listen()
+	srcAccepted, backendAccepted := accept(proxyListener), accept(backendListener)
+	client := dial(proxyListener.Addr().String())
+	dst := dial(backendListener.Addr().String())
+	src, backend := <-srcAccepted, <-backendAccepted
+	if src == nil || backend == nil {
+		t.Fatal("Accept failed")
+	}
+	t.Cleanup(func() { src.Close(); backend.Close() })
+
+	tf := &testForward{
+		client:  client.(*net.TCPConn),
+		backend: backend.(*net.TCPConn),
+		session: newForwardSession(src, dst, "test", "test"),
+		done:    make(chan struct{}),
+	}
+	forward(tf.session, &forwardRule{name: "test"}, func() { close(tf.done) })
+	return tf
+}
+
+// wait fails the test unless the session is released in time
+func (tf *testForward) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-tf.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not released")
+	}
+}
+
+// readAll reads from conn until EOF or an error
+func readAll(t *testing.T, conn net.Conn) ([]byte, error) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return io.ReadAll(conn)
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	tf := startTestForward(t)
+
+	if _, err := tf.client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readAll(t, tf.backend)
+	if err != nil || "request" != string(got) {
+		t.Fatalf("backend read %q, %v; want the request followed by EOF", got, err)
+	}
+
+	// the client's half close must not stop the reply
+	if _, err := tf.backend.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	tf.backend.Close()
+	got, err = readAll(t, tf.client)
+	if err != nil || "reply" != string(got) {
+		t.Fatalf("client read %q, %v; want the reply followed by EOF", got, err)
+	}
+	tf.wait(t)
+}
+
+func TestForwardClosesBothSides(t *testing.T) {
+	tests := []struct {
+		name   string
+		closer func(tf *testForward) *net.TCPConn
+		other  func(tf *testForward) *net.TCPConn
+	}{
+		{"client first", func(tf *testForward) *net.TCPConn { return tf.client }, func(tf *testForward) *net.TCPConn { return tf.backend }},
+		{"backend first", func(tf *testForward) *net.TCPConn { return tf.backend }, func(tf *testForward) *net.TCPConn { return tf.client }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := startTestForward(t)
+			tt.closer(tf).Close()
+			// the other side sees EOF and finishes as well
+			if _, err := readAll(t, tt.other(tf)); err != nil {
+				t.Fatalf("read after the other side closed: %s", err)
+			}
+			tt.other(tf).Close()
+			tf.wait(t)
+
+			for _, conn := range []net.Conn{tf.session.src, tf.session.dst} {
+				if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+					t.Errorf("%v is not closed: %v", conn.LocalAddr(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardErrorClosesOtherDirection(t *testing.T) {
+	tf := startTestForward(t)
+
+	// a reset from the backend is an error in the upstream to client direction
+	tf.backend.SetLinger(0)
+	tf.backend.Close()
+
+	// the client never closes; the session must end anyway
+	if _, err := readAll(t, tf.client); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatal("client connection was left open")
+		}
+	}
+	tf.wait(t)
+
+	tf.session.mu.Lock()
+	reason := tf.session.closeReason
+	tf.session.mu.Unlock()
+	if closeError != reason {
+		t.Errorf("close reason = %q, want %q", reason, closeError)
+	}
+}
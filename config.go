@@ -0,0 +1,734 @@
+/*
+config.go
+
+A forwarding rule is a single listener with its own target and admission policy.
+Rules come from the command line (a single implicit rule) and/or from an ini file
+given with --config, where every section is one rule. See gofwd-example.ini
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"gopkg.in/ini.v1"
+)
+
+// ruleConfig is the unvalidated description of a rule; the keys in a --config file match the command line option names
+type ruleConfig struct {
+	name         string
+	from         string
+	to           string
+	proto        string
+	unixMode     string
+	balance      string
+	sni          string
+	city         string
+	region       string
+	country      string
+	loc          string
+	distance     float64
+	allowCIDR    string
+	denyCIDR     string
+	private      bool
+	acceptProxy  string
+	sendProxy    string
+	tlsCert      string
+	tlsKey       string
+	tlsMin       string
+	tlsClientCA  string
+	tlsAllow     string
+	tlsSkip      string
+	duoIdentity  bool
+	socks5       bool
+	httpConnect  bool
+	proxyAllow   string
+	proxyUsers   string
+	toTLS        bool
+	toTLSSNI     string
+	toTLSCA      string
+	toTLSCert    string
+	toTLSKey     string
+	toTLSVerify  string
+	duo          string
+	duoCacheTime int64
+	udpTimeout   int64
+	idleTimeout  int64
+	maxSession   int64
+	health       healthCheck
+	dial         dialSettings
+}
+
+// forwardRule is a validated rule, ready to be started
+type forwardRule struct {
+	name        string
+	from        string
+	to          string
+	proto       string
+	unixMode    os.FileMode
+	sni         string
+	acceptProxy string
+	sendProxy   string
+	tlsConfig   *tls.Config
+	upstreamTLS *tls.Config
+	proxy       *proxyConfig
+	udpTimeout  time.Duration
+	idleTimeout time.Duration
+	maxSession  time.Duration
+	backends    *backendPool
+	dial        dialSettings
+	policy      *admissionPolicy
+}
+
+// ruleFlags are the command line options of the implicit rule, other than --from and --to; they are keys of the same name in a --config file
+var ruleFlags = []string{
+	"proto", "unix-mode", "balance", "sni", "city", "region", "country", "loc", "distance", "allow", "deny", "private",
+	"accept-proxy", "send-proxy", "tls-cert", "tls-key", "tls-min-version", "tls-client-ca", "tls-client-allow",
+	"tls-client-skip", "duo", "duo-identity-user", "duo-cache-time", "socks5", "http-connect", "proxy-allow",
+	"proxy-users", "to-tls", "to-tls-sni", "to-tls-ca", "to-tls-cert", "to-tls-key", "to-tls-verify", "to-source",
+	"udp-timeout", "idle-timeout", "max-session", "health-interval", "health-timeout", "health-send", "health-expect",
+	"dial-timeout", "dial-retries", "dial-backoff", "keepalive",
+}
+
+// givenRuleFlags returns the ruleFlags that were given on the command line
+func givenRuleFlags() []string {
+	ctx, err := kingpin.CommandLine.ParseContext(os.Args[1:])
+	if err != nil {
+		return nil
+	}
+	var given []string
+	for _, element := range ctx.Elements {
+		flag, ok := element.Clause.(*kingpin.FlagClause)
+		if ok && slices.Contains(ruleFlags, flag.Model().Name) && !slices.Contains(given, flag.Model().Name) {
+			given = append(given, flag.Model().Name)
+		}
+	}
+	return given
+}
+
+// ruleConfigFromFlags returns the implicit rule defined by the command line options
+func ruleConfigFromFlags() ruleConfig {
+	return ruleConfig{
+		name:         "cmdline",
+		from:         *from,
+		to:           *to,
+		proto:        *proto,
+		unixMode:     *unixMode,
+		balance:      *balance,
+		sni:          strings.ToLower(*sni),
+		city:         *city,
+		region:       *region,
+		country:      *country,
+		loc:          *loc,
+		distance:     *distance,
+		allowCIDR:    *allowCIDR,
+		denyCIDR:     *denyCIDR,
+		private:      *private,
+		acceptProxy:  *acceptProxy,
+		sendProxy:    *sendProxy,
+		tlsCert:      *tlsCert,
+		tlsKey:       *tlsKey,
+		tlsMin:       *tlsMin,
+		tlsClientCA:  *tlsClientCA,
+		tlsAllow:     *tlsAllow,
+		tlsSkip:      *tlsSkip,
+		duoIdentity:  *duoIdentity,
+		socks5:       *socks5,
+		httpConnect:  *httpConnect,
+		proxyAllow:   *proxyAllow,
+		proxyUsers:   *proxyUsers,
+		toTLS:        *toTLS,
+		toTLSSNI:     *toTLSSNI,
+		toTLSCA:      *toTLSCA,
+		toTLSCert:    *toTLSCert,
+		toTLSKey:     *toTLSKey,
+		toTLSVerify:  *toTLSVerify,
+		duo:          *duo,
+		duoCacheTime: *duoAuthCacheTime,
+		udpTimeout:   *udpTimeout,
+		idleTimeout:  *idleTimeout,
+		maxSession:   *maxSession,
+		health: healthCheck{
+			interval: time.Duration(*healthEvery) * time.Second,
+			timeout:  time.Duration(*healthTimeout) * time.Second,
+			send:     *healthSend,
+			expect:   *healthExpect,
+		},
+		dial: dialSettings{
+			timeout:   time.Duration(*dialTimeout) * time.Second,
+			retries:   *dialRetries,
+			backoff:   time.Duration(*dialBackoff) * time.Millisecond,
+			keepAlive: time.Duration(*keepAlive) * time.Second,
+			source:    *toSource,
+		},
+	}
+}
+
+/*
+readRuleConfigFile reads an ini file where each section is a rule, for example:
+
+	[ssh]
+	from=0.0.0.0:2222
+	to=192.168.1.10:22
+	region=Colorado
+	duo=duo.ini:testuser
+
+Keys that are not given default to the value of the corresponding command line option's default.
+*/
+func readRuleConfigFile(path string) ([]ruleConfig, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read file: %v", err)
+	}
+
+	var configs []ruleConfig
+	for _, section := range cfg.Sections() {
+		if ini.DefaultSection == section.Name() {
+			continue
+		}
+		rule := ruleConfig{
+			name:         section.Name(),
+			from:         section.Key("from").String(),
+			to:           section.Key("to").String(),
+			proto:        section.Key("proto").MustString("tcp"),
+			unixMode:     section.Key("unix-mode").MustString("0660"),
+			balance:      section.Key("balance").MustString(balanceRoundRobin),
+			sni:          strings.ToLower(section.Key("sni").String()),
+			city:         section.Key("city").String(),
+			region:       section.Key("region").String(),
+			country:      section.Key("country").String(),
+			loc:          section.Key("loc").String(),
+			allowCIDR:    section.Key("allow").String(),
+			denyCIDR:     section.Key("deny").String(),
+			duo:          section.Key("duo").String(),
+			acceptProxy:  section.Key("accept-proxy").String(),
+			sendProxy:    section.Key("send-proxy").String(),
+			tlsCert:      section.Key("tls-cert").String(),
+			tlsKey:       section.Key("tls-key").String(),
+			tlsMin:       section.Key("tls-min-version").MustString("1.2"),
+			tlsClientCA:  section.Key("tls-client-ca").String(),
+			tlsAllow:     section.Key("tls-client-allow").String(),
+			tlsSkip:      section.Key("tls-client-skip").MustString(identitySkipNone),
+			duoIdentity:  section.Key("duo-identity-user").MustBool(false),
+			socks5:       section.Key("socks5").MustBool(false),
+			httpConnect:  section.Key("http-connect").MustBool(false),
+			proxyAllow:   section.Key("proxy-allow").String(),
+			proxyUsers:   section.Key("proxy-users").String(),
+			toTLS:        section.Key("to-tls").MustBool(false),
+			toTLSSNI:     section.Key("to-tls-sni").String(),
+			toTLSCA:      section.Key("to-tls-ca").String(),
+			toTLSCert:    section.Key("to-tls-cert").String(),
+			toTLSKey:     section.Key("to-tls-key").String(),
+			toTLSVerify:  section.Key("to-tls-verify").MustString(verifyFull),
+			duoCacheTime: section.Key("duo-cache-time").MustInt64(120),
+			udpTimeout:   section.Key("udp-timeout").MustInt64(60),
+			idleTimeout:  section.Key("idle-timeout").MustInt64(0),
+			maxSession:   section.Key("max-session").MustInt64(0),
+			health: healthCheck{
+				interval: time.Duration(section.Key("health-interval").MustInt64(0)) * time.Second,
+				timeout:  time.Duration(section.Key("health-timeout").MustInt64(5)) * time.Second,
+				send:     section.Key("health-send").String(),
+				expect:   section.Key("health-expect").String(),
+			},
+			dial: dialSettings{
+				timeout:   time.Duration(section.Key("dial-timeout").MustInt64(10)) * time.Second,
+				retries:   section.Key("dial-retries").MustInt(0),
+				backoff:   time.Duration(section.Key("dial-backoff").MustInt64(250)) * time.Millisecond,
+				keepAlive: time.Duration(section.Key("keepalive").MustInt64(15)) * time.Second,
+				source:    section.Key("to-source").String(),
+			},
+		}
+		if rule.distance, err = section.Key("distance").Float64(); err != nil && len(section.Key("distance").String()) > 0 {
+			return nil, fmt.Errorf("[%s] Invalid distance: %s", rule.name, section.Key("distance").String())
+		}
+		if rule.private, err = section.Key("private").Bool(); err != nil && len(section.Key("private").String()) > 0 {
+			return nil, fmt.Errorf("[%s] Invalid private: %s", rule.name, section.Key("private").String())
+		}
+		configs = append(configs, rule)
+	}
+	if 0 == len(configs) {
+		return nil, fmt.Errorf("No rules found in %s", path)
+	}
+	return configs, nil
+}
+
+/*
+loadRuleConfigs returns every rule: the one given on the command line (if any) and those in the --config file
+The rules are validated and each of them must have its own listening address, unless they are SNI routes.
+This is called at startup and again for each SIGHUP.
+*/
+func loadRuleConfigs() ([]ruleConfig, error) {
+	var configs []ruleConfig
+	if len(*from) > 0 || len(*to) > 0 || 0 == len(*configFile) {
+		configs = append(configs, ruleConfigFromFlags())
+	} else if given := givenRuleFlags(); len(given) > 0 {
+		// without --from and --to there is no command line rule for these to apply to
+		return nil, fmt.Errorf("--%s only apply to the rule given with --from and --to; set them in the rules of %s instead", strings.Join(given, ", --"), *configFile)
+	}
+	if len(*configFile) > 0 {
+		fileConfigs, err := readRuleConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, fileConfigs...)
+	}
+
+	seen := make(map[string][]*ruleConfig)
+	for i := range configs {
+		cfg := &configs[i]
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("[%s] %s", cfg.name, err)
+		}
+		mappings, err := cfg.portMappings()
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %s", cfg.name, err)
+		}
+		for _, mapping := range mappings {
+			key := ruleKey(cfg.proto, mapping.from)
+			for _, other := range seen[key] {
+				if 0 == len(cfg.sni) || 0 == len(other.sni) {
+					return nil, fmt.Errorf("[%s] [%s] is already used by rule: %s; rules can only share a listener when all of them have an sni key", cfg.name, key, other.name)
+				}
+				if cfg.sni == other.sni {
+					return nil, fmt.Errorf("[%s] sni %s is already used by rule: %s", cfg.name, cfg.sni, other.name)
+				}
+				if cfg.acceptProxy != other.acceptProxy || cfg.dial.keepAlive != other.dial.keepAlive {
+					return nil, fmt.Errorf("[%s] accept-proxy and keepalive must be the same for all rules of [%s]", cfg.name, key)
+				}
+			}
+			seen[key] = append(seen[key], cfg)
+		}
+	}
+	return configs, nil
+}
+
+// validate checks a rule for errors and resolves an adapter name given in the from address
+func (cfg *ruleConfig) validate() error {
+	proxyMode := cfg.socks5 || cfg.httpConnect
+	if proxyMode {
+		if err := cfg.validateProxy(); err != nil {
+			return err
+		}
+	} else if 0 == len(cfg.from) || 0 == len(cfg.to) {
+		return fmt.Errorf("Both --from and --to are mandatory")
+	} else if len(cfg.proxyAllow) > 0 || len(cfg.proxyUsers) > 0 {
+		return fmt.Errorf("--proxy-allow and --proxy-users require --socks5 or --http-connect")
+	}
+
+	backends := splitBackends(cfg.to)
+	if 0 == len(backends) && !proxyMode {
+		return fmt.Errorf("Both --from and --to are mandatory")
+	}
+
+	if !strings.Contains(cfg.from, ":") {
+		return fmt.Errorf("--from does not contain a ':' character")
+	}
+
+	for _, backend := range backends {
+		if cfg.from == backend {
+			return fmt.Errorf("--from and --to can not be identical")
+		}
+		if path, ok := unixSocketPath(backend); ok {
+			if 0 == len(path) || "tcp" != cfg.proto {
+				return fmt.Errorf("--to Unix socket requires a path and --proto tcp: %s", backend)
+			}
+			continue
+		}
+		if !strings.Contains(backend, ":") {
+			return fmt.Errorf("--to does not contain a ':' character: %s", backend)
+		}
+	}
+
+	if balanceRoundRobin != cfg.balance && balanceLeastConn != cfg.balance && balanceHash != cfg.balance {
+		return fmt.Errorf("--balance must be roundrobin, leastconn or hash: %s", cfg.balance)
+	}
+
+	if "tcp" != cfg.proto && "udp" != cfg.proto {
+		return fmt.Errorf("--proto must be tcp or udp: %s", cfg.proto)
+	}
+
+	if strings.HasPrefix(cfg.from, "_") {
+		address, err := resolveNicAddress(cfg.from)
+		if err != nil {
+			return err
+		}
+		cfg.from = address
+	}
+
+	if path, ok := unixSocketPath(cfg.from); ok {
+		if 0 == len(path) || "tcp" != cfg.proto {
+			return fmt.Errorf("--from Unix socket requires a path and --proto tcp: %s", cfg.from)
+		}
+		if _, err := parseUnixMode(cfg.unixMode); err != nil {
+			return err
+		}
+	} else if _, _, err := net.SplitHostPort(cfg.from); err != nil {
+		return fmt.Errorf("Invalid --from address: %s", err)
+	}
+
+	for _, backend := range backends {
+		if _, ok := unixSocketPath(backend); ok {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(backend); err != nil {
+			return fmt.Errorf("Invalid --to address: %s", err)
+		}
+	}
+
+	if len(cfg.loc) > 0 && 0 == cfg.distance {
+		return fmt.Errorf("--distance must be used with --loc")
+	}
+
+	if cfg.distance > 0 && (len(cfg.city) > 0 || len(cfg.region) > 0 || len(cfg.country) > 0) {
+		return fmt.Errorf("--distance can not be used with any of these: city, region, country; Instead, use --loc with --distance")
+	}
+
+	if len(cfg.denyCIDR) > 0 {
+		if badCIDR, ok := validateCIDRList(&cfg.denyCIDR); !ok {
+			return fmt.Errorf("Invalid CIDR given for -D option: %s", badCIDR)
+		}
+	}
+
+	if len(cfg.allowCIDR) > 0 {
+		if badCIDR, ok := validateCIDRList(&cfg.allowCIDR); !ok {
+			return fmt.Errorf("Invalid CIDR given for -A option: %s", badCIDR)
+		}
+	}
+
+	if cfg.idleTimeout < 0 || cfg.maxSession < 0 {
+		return fmt.Errorf("--idle-timeout and --max-session can not be negative")
+	}
+
+	if cfg.health.interval < 0 || cfg.health.timeout <= 0 {
+		return fmt.Errorf("--health-interval can not be negative and --health-timeout must be positive")
+	}
+
+	if cfg.health.interval > 0 && "udp" == cfg.proto && 0 == len(cfg.health.expect) {
+		return fmt.Errorf("UDP health checks require --health-expect")
+	}
+
+	if len(cfg.acceptProxy) > 0 {
+		if badCIDR, ok := validateCIDRList(&cfg.acceptProxy); !ok {
+			return fmt.Errorf("Invalid CIDR given for --accept-proxy option: %s", badCIDR)
+		}
+	}
+
+	if len(cfg.sendProxy) > 0 && "v1" != cfg.sendProxy && "v2" != cfg.sendProxy {
+		return fmt.Errorf("--send-proxy must be v1 or v2: %s", cfg.sendProxy)
+	}
+
+	if "udp" == cfg.proto && (len(cfg.acceptProxy) > 0 || len(cfg.sendProxy) > 0) {
+		return fmt.Errorf("--accept-proxy and --send-proxy can only be used with tcp")
+	}
+
+	if (len(cfg.tlsCert) > 0) != (len(cfg.tlsKey) > 0) {
+		return fmt.Errorf("--tls-cert and --tls-key must be used together")
+	}
+
+	if len(cfg.tlsCert) > 0 && "udp" == cfg.proto {
+		return fmt.Errorf("--tls-cert can only be used with tcp")
+	}
+
+	if _, found := tlsVersions[cfg.tlsMin]; !found {
+		return fmt.Errorf("--tls-min-version must be 1.0, 1.1, 1.2 or 1.3: %s", cfg.tlsMin)
+	}
+
+	if len(cfg.tlsClientCA) > 0 && 0 == len(cfg.tlsCert) {
+		return fmt.Errorf("--tls-client-ca requires --tls-cert")
+	}
+
+	if (len(cfg.tlsAllow) > 0 || identitySkipNone != cfg.tlsSkip) && 0 == len(cfg.tlsClientCA) {
+		return fmt.Errorf("--tls-client-allow and --tls-client-skip require --tls-client-ca")
+	}
+
+	if cfg.duoIdentity && 0 == len(cfg.tlsClientCA) && 0 == len(cfg.proxyUsers) {
+		return fmt.Errorf("--duo-identity-user requires --tls-client-ca or --proxy-users")
+	}
+
+	if identitySkipNone != cfg.tlsSkip && identitySkipGeo != cfg.tlsSkip && identitySkipAll != cfg.tlsSkip {
+		return fmt.Errorf("--tls-client-skip must be none, geo or all: %s", cfg.tlsSkip)
+	}
+
+	if identitySkipNone != cfg.tlsSkip && 0 == len(cfg.tlsAllow) {
+		return fmt.Errorf("--tls-client-skip requires --tls-client-allow")
+	}
+
+	if cfg.duoIdentity && 0 == len(cfg.duo) {
+		return fmt.Errorf("--duo-identity-user requires --duo")
+	}
+
+	if (len(cfg.toTLSSNI) > 0 || len(cfg.toTLSCA) > 0 || len(cfg.toTLSCert) > 0 || verifyFull != cfg.toTLSVerify) && !cfg.toTLS {
+		return fmt.Errorf("--to-tls-sni, --to-tls-ca, --to-tls-cert and --to-tls-verify require --to-tls")
+	}
+
+	if (len(cfg.toTLSCert) > 0) != (len(cfg.toTLSKey) > 0) {
+		return fmt.Errorf("--to-tls-cert and --to-tls-key must be used together")
+	}
+
+	if verifyFull != cfg.toTLSVerify && verifyCAOnly != cfg.toTLSVerify && verifyNone != cfg.toTLSVerify {
+		return fmt.Errorf("--to-tls-verify must be full, ca-only or none: %s", cfg.toTLSVerify)
+	}
+
+	if cfg.toTLS && "udp" == cfg.proto {
+		return fmt.Errorf("--to-tls can only be used with tcp")
+	}
+
+	if cfg.toTLS && 0 == len(cfg.toTLSSNI) && verifyNone != cfg.toTLSVerify && strings.Contains(cfg.to, unixPrefix) {
+		return fmt.Errorf("--to-tls with a Unix socket backend requires --to-tls-sni")
+	}
+
+	if len(cfg.sni) > 0 && !validSNIPattern(cfg.sni) {
+		return fmt.Errorf("Invalid --sni server name: %s", cfg.sni)
+	}
+
+	if len(cfg.sni) > 0 && ("udp" == cfg.proto || len(cfg.tlsCert) > 0) {
+		return fmt.Errorf("--sni can only be used with tcp and without --tls-cert")
+	}
+
+	if cfg.dial.timeout < 0 || cfg.dial.retries < 0 || cfg.dial.backoff < 0 || cfg.dial.keepAlive < 0 {
+		return fmt.Errorf("--dial-timeout, --dial-retries, --dial-backoff and --keepalive can not be negative")
+	}
+
+	if len(cfg.dial.source) > 0 {
+		source, err := resolveToSource(cfg.dial.source)
+		if err != nil {
+			return err
+		}
+		cfg.dial.source = source
+	}
+
+	if len(cfg.duo) > 0 && len(strings.Split(cfg.duo, ":")) != 2 {
+		return fmt.Errorf("Invalid duo filename / user combination")
+	}
+
+	return nil
+}
+
+// validateProxy checks the options of a --socks5 or --http-connect rule, which has no --to backends
+func (cfg *ruleConfig) validateProxy() error {
+	if cfg.socks5 && cfg.httpConnect {
+		return fmt.Errorf("--socks5 and --http-connect can not be used together")
+	}
+	if 0 == len(cfg.from) {
+		return fmt.Errorf("--from is mandatory")
+	}
+	if len(cfg.to) > 0 {
+		return fmt.Errorf("--to can not be used with --socks5 or --http-connect; the client picks the destination")
+	}
+	if "tcp" != cfg.proto {
+		return fmt.Errorf("--socks5 and --http-connect can only be used with tcp")
+	}
+	if 0 == len(cfg.proxyAllow) {
+		return fmt.Errorf("--socks5 and --http-connect require --proxy-allow")
+	}
+	if _, err := parseDestinationAllow(cfg.proxyAllow); err != nil {
+		return err
+	}
+	if cfg.toTLS || len(cfg.sendProxy) > 0 || len(cfg.sni) > 0 || len(cfg.tlsCert) > 0 || cfg.health.interval > 0 {
+		return fmt.Errorf("--socks5 and --http-connect can not be used with --to-tls, --send-proxy, --sni, --tls-cert or --health-interval")
+	}
+	return nil
+}
+
+/*
+buildRule turns a validated ruleConfig into forwardRules: one, or one per port of a port range
+
+Args:
+
+	cfg: a rule that has passed validate()
+
+	geo: the geo-ip providers shared by all rules
+
+	selfGeoIP: the public location of this host according to ipinfo.io, or nil when ipinfo.io is not used
+
+Returns:
+
+	the rules, which share one admission policy, or an error if the Duo configuration can not be read
+	or the rule's location can not be determined
+*/
+func buildRule(cfg ruleConfig, geo *geoProviderChain, selfGeoIP *ipInfoResult) ([]*forwardRule, error) {
+	var restrictionsGeoIP ipInfoResult
+	restrictionsGeoIP.City = cfg.city
+	restrictionsGeoIP.Region = cfg.region
+	restrictionsGeoIP.Country = cfg.country
+	restrictionsGeoIP.Distance = cfg.distance
+	restrictionsGeoIP.Loc = cfg.loc
+
+	var localGeoIP ipInfoResult
+	if selfGeoIP != nil {
+		localGeoIP = *selfGeoIP
+	} else {
+		localGeoIP = getLocalGeoIPOffline(cfg.from, geo)
+		if restrictionsGeoIP.Distance > 0 && 0 == len(restrictionsGeoIP.Loc) && 0 == len(localGeoIP.Loc) {
+			return nil, fmt.Errorf("--distance without --loc requires a public --from address when not using ipinfo")
+		}
+	}
+
+	var duoAuth *duoGate
+	var duoIdentityUsers *duoUsers
+	if len(cfg.duo) > 0 {
+		slots := strings.Split(cfg.duo, ":")
+		duoCred, err := duoReadConfig(slots[0], slots[1])
+		if err != nil {
+			return nil, err
+		}
+		duoAuth = newDuoGate(duoCred, cfg.duoCacheTime, time.Duration(*duoTimeout)*time.Second)
+		if cfg.duoIdentity {
+			duoIdentityUsers = newDuoUsers(slots[0], cfg.duoCacheTime, time.Duration(*duoTimeout)*time.Second)
+		}
+	}
+
+	var identityAllow []string
+	if len(cfg.tlsAllow) > 0 {
+		for _, name := range strings.Split(cfg.tlsAllow, ",") {
+			identityAllow = append(identityAllow, strings.TrimSpace(name))
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if len(cfg.tlsCert) > 0 {
+		var err error
+		if tlsConfig, err = newServerTLSConfig(cfg.tlsCert, cfg.tlsKey, cfg.tlsMin, cfg.tlsClientCA); err != nil {
+			return nil, err
+		}
+	}
+
+	var upstreamTLS *tls.Config
+	if cfg.toTLS {
+		var err error
+		if upstreamTLS, err = newUpstreamTLSConfig(cfg.toTLSSNI, cfg.toTLSCA, cfg.toTLSCert, cfg.toTLSKey, cfg.toTLSVerify); err != nil {
+			return nil, err
+		}
+	}
+
+	var proxy *proxyConfig
+	if cfg.socks5 || cfg.httpConnect {
+		proxy = &proxyConfig{mode: proxySOCKS5, allowList: cfg.proxyAllow}
+		if cfg.httpConnect {
+			proxy.mode = proxyHTTPConnect
+		}
+		var err error
+		if proxy.allow, err = parseDestinationAllow(cfg.proxyAllow); err != nil {
+			return nil, err
+		}
+		if len(cfg.proxyUsers) > 0 {
+			if proxy.users, err = readProxyUsers(cfg.proxyUsers); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	policy := &admissionPolicy{
+		name:              cfg.name,
+		localGeoIP:        localGeoIP,
+		restrictionsGeoIP: restrictionsGeoIP,
+		allowCIDR:         cfg.allowCIDR,
+		denyCIDR:          cfg.denyCIDR,
+		allowPrivateIP:    cfg.private,
+		geo:               geo,
+		duo:               duoAuth,
+		duoUsers:          duoIdentityUsers,
+		requireIdentity:   len(cfg.tlsClientCA) > 0,
+		identityAllow:     identityAllow,
+		identitySkip:      cfg.tlsSkip,
+	}
+	unixMode, _ := parseUnixMode(cfg.unixMode)
+
+	mappings, err := cfg.portMappings()
+	if err != nil {
+		return nil, err
+	}
+	var rules []*forwardRule
+	for _, mapping := range mappings {
+		rules = append(rules, &forwardRule{
+			name:        cfg.name,
+			from:        mapping.from,
+			to:          mapping.to,
+			proto:       cfg.proto,
+			unixMode:    unixMode,
+			sni:         cfg.sni,
+			acceptProxy: cfg.acceptProxy,
+			sendProxy:   cfg.sendProxy,
+			tlsConfig:   tlsConfig,
+			upstreamTLS: upstreamTLS,
+			proxy:       proxy,
+			udpTimeout:  time.Duration(cfg.udpTimeout) * time.Second,
+			idleTimeout: time.Duration(cfg.idleTimeout) * time.Second,
+			maxSession:  time.Duration(cfg.maxSession) * time.Second,
+			dial:        cfg.dial,
+			backends:    newBackendPool(cfg.name, cfg.proto, mapping.to, cfg.balance, *backendFails, time.Duration(*backendCool)*time.Second, cfg.health),
+			policy:      policy,
+		})
+	}
+	return rules, nil
+}
+
+// buildRules calls buildRule for each config; see buildRule
+func buildRules(configs []ruleConfig, geo *geoProviderChain, selfGeoIP *ipInfoResult) ([]*forwardRule, error) {
+	var rules []*forwardRule
+	for _, cfg := range configs {
+		built, err := buildRule(cfg, geo, selfGeoIP)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %s", cfg.name, err)
+		}
+		if len(built) > 1 {
+			logger.Infof("[%s] port range: %d listeners from [%s] to [%s], sharing one admission policy and Duo cache", cfg.name, len(built), cfg.from, cfg.to)
+		}
+		logRule(built[0])
+		rules = append(rules, built...)
+	}
+	return rules, nil
+}
+
+// logRule shows a rule's settings when it is started
+func logRule(rule *forwardRule) {
+	logger.Infof("[%s] from: [%s] to: [%s] [%s]", rule.name, rule.from, rule.to, rule.proto)
+	if len(rule.backends.backends) > 1 {
+		logger.Infof("[%s] %d backends; balance: %s", rule.name, len(rule.backends.backends), rule.backends.mode)
+	}
+	logger.Infof("[%s] Geo IP Restrictions: %v", rule.name, rule.policy.restrictionsGeoIP)
+	if _, ok := unixSocketPath(rule.from); ok {
+		logger.Infof("[%s] Unix socket mode: %04o", rule.name, rule.unixMode)
+	}
+	if rule.proxy != nil {
+		logger.Infof("[%s] %s proxy; allowed destinations: %s; users: %d", rule.name, rule.proxy.mode, rule.proxy.allowList, len(rule.proxy.users))
+	}
+	if len(rule.acceptProxy) > 0 {
+		logger.Infof("[%s] PROXY protocol header required from: %s", rule.name, rule.acceptProxy)
+	}
+	if rule.tlsConfig != nil {
+		logger.Infof("[%s] TLS termination; minimum version: %s", rule.name, tlsVersionName(rule.tlsConfig.MinVersion))
+	}
+	if len(rule.policy.identityAllow) > 0 {
+		logger.Infof("[%s] client certificates allowed: %s; replacing checks: %s", rule.name, strings.Join(rule.policy.identityAllow, ","), rule.policy.identitySkip)
+	}
+	if rule.upstreamTLS != nil {
+		serverName := rule.upstreamTLS.ServerName
+		if 0 == len(serverName) {
+			serverName = "(backend host name)"
+		}
+		logger.Infof("[%s] connecting to backends with TLS; server name: %s", rule.name, serverName)
+	}
+	if len(rule.sendProxy) > 0 {
+		logger.Infof("[%s] sending PROXY protocol %s header to backends", rule.name, rule.sendProxy)
+	}
+	if len(rule.dial.source) > 0 {
+		logger.Infof("[%s] connecting to backends from: %s", rule.name, rule.dial.source)
+	}
+	if rule.backends.check.interval > 0 {
+		logger.Infof("[%s] health checks every %v", rule.name, rule.backends.check.interval)
+	}
+	if rule.idleTimeout > 0 || rule.maxSession > 0 {
+		logger.Infof("[%s] idle timeout: %v; max session: %v", rule.name, rule.idleTimeout, rule.maxSession)
+	}
+	if rule.policy.duo != nil {
+		logger.Infof("[%s] Duo auth activated for user: %s; cache time: %v seconds", rule.name, rule.policy.duo.cred.name, rule.policy.duo.cacheTime)
+	}
+}
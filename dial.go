@@ -0,0 +1,98 @@
+/*
+dial.go
+
+How gofwd connects to the backends of a rule: a dial timeout, a number of retries with
+exponential backoff when every backend failed, TCP keepalive on both the client and the
+upstream connection, and an optional local source address (--to-source) for multi-homed
+hosts, which can be given as an adapter name such as _eth0 or _eth0/6.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// dialSettings are the per-rule options for upstream connections
+type dialSettings struct {
+	timeout   time.Duration
+	retries   int
+	backoff   time.Duration
+	keepAlive time.Duration
+	source    string
+}
+
+// resolveToSource returns the IP address to use for --to-source, which can also be an adapter name such as _eth0 or _eth0/6
+func resolveToSource(source string) (string, error) {
+	if strings.HasPrefix(source, "_") {
+		address, err := resolveNicAddress(source + ":0")
+		if err != nil {
+			return "", err
+		}
+		host, _, err := net.SplitHostPort(address)
+		return host, err
+	}
+	if nil == net.ParseIP(strings.Split(source, "%")[0]) {
+		return "", fmt.Errorf("Invalid --to-source address: %s", source)
+	}
+	return source, nil
+}
+
+// dialUpstream opens a connection to a single backend address of the rule
+func (rule *forwardRule) dialUpstream(address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: rule.dial.timeout, KeepAlive: rule.dial.keepAlive}
+	if 0 == rule.dial.keepAlive {
+		dialer.KeepAlive = -1
+	}
+	network, address := dialNetwork(rule.proto, address)
+	if len(rule.dial.source) > 0 && "unix" != network {
+		ip, zone, _ := strings.Cut(rule.dial.source, "%")
+		if "udp" == rule.proto {
+			dialer.LocalAddr = &net.UDPAddr{IP: net.ParseIP(ip), Zone: zone}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(ip), Zone: zone}
+		}
+	}
+	return dialer.Dial(network, address)
+}
+
+/*
+dialBackend connects to one of the rule's backends, retrying with exponential backoff
+
+Args:
+
+	clientIP: the address of the client, used for source-IP hashing
+
+Returns:
+
+	the connection and its backend, which must be released when the connection ends,
+	or the error of the last attempt
+*/
+func (rule *forwardRule) dialBackend(clientIP string) (net.Conn, *backend, error) {
+	for attempt := 0; ; attempt++ {
+		conn, b, err := rule.backends.dial(clientIP, rule.dialUpstream)
+		if err == nil || attempt >= rule.dial.retries {
+			return conn, b, err
+		}
+		delay := rule.dial.backoff << attempt
+		logger.Infof("[%s] retrying in %v; attempt %d of %d", rule.name, delay, attempt+1, rule.dial.retries)
+		time.Sleep(delay)
+	}
+}
+
+// setKeepAlive applies the rule's keepalive setting to an accepted client connection
+func setKeepAlive(conn net.Conn, keepAlive time.Duration) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if 0 == keepAlive {
+		errHandler(tcp.SetKeepAlive(false), false)
+		return
+	}
+	errHandler(tcp.SetKeepAlive(true), false)
+	errHandler(tcp.SetKeepAlivePeriod(keepAlive), false)
+}
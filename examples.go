@@ -10,10 +10,28 @@ func getExamples() [][]string {
 	examples = append(examples, []string{`allow only if remote IP is located in Canada`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 -country CA`})
 	examples = append(examples, []string{`allow only if remote IP is located within 75 miles of Atlanta, GA`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 -l 33.756529,-84.400996 -d 75`})
 	examples = append(examples, []string{`    to get Latitude, Longitude use https://www.latlong.net/`, ` `})
+	examples = append(examples, []string{`allow only if remote IP is located in Canada, using an offline geo-ip database`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 -country CA --geoip-db GeoLite2-City.mmdb`})
+	examples = append(examples, []string{`use ipinfo.io with an API token, fall back to an offline geo-ip database`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 -country CA --geoip-chain ipinfo,mmdb --ipinfo-token abc123 --geoip-db GeoLite2-City.mmdb`})
 	examples = append(examples, []string{`allow only for a successful two-factor duo auth for 'testuser'`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 --duo duo.ini:testuser`})
 	examples = append(examples, []string{`allow only after both Geo IP and Duo are verified`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 --region Texas --duo duo.ini:testuser`})
+	examples = append(examples, []string{`forward to two backends, each client IP always uses the same one`, `gofwd -f 1.2.3.4:443 -t 192.168.1.10:443,192.168.1.11:443 --balance hash`})
+	examples = append(examples, []string{`check every 10 seconds that the SSH server is up, deny right away while it is not`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 --health-interval 10 --health-expect SSH-2.0`})
+	examples = append(examples, []string{`connect to the backend from the address of eth1, retry twice when it is unreachable`, `gofwd -f 1.2.3.4:22 -t 10.1.1.1:22 --to-source _eth1 --dial-timeout 5 --dial-retries 2`})
+	examples = append(examples, []string{`behind a load balancer in 10.0.0.0/16, pass the client address on to the backend`, `gofwd -f 0.0.0.0:22 -t 192.168.1.1:22 --accept-proxy 10.0.0.0/16 --send-proxy v2`})
+	examples = append(examples, []string{`accept TLS 1.3 connections and forward them, decrypted, to a plain TCP service`, `gofwd -f 1.2.3.4:8443 -t 192.168.1.1:8080 --tls-cert fullchain.pem --tls-key privkey.pem --tls-min-version 1.3`})
+	examples = append(examples, []string{`allow only client certificates for alice or bob from our CA, skip geo-ip, then Duo push to that user`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 --tls-cert cert.pem --tls-key key.pem --tls-client-ca ca.pem --tls-client-allow alice,bob --tls-client-skip geo --duo duo.ini:alice --duo-identity-user`})
+	examples = append(examples, []string{`forward plain text clients to a backend that only accepts TLS, verified with our own CA`, `gofwd -f 10.8.0.1:389 -t ldap.example.com:636 --to-tls --to-tls-ca ca.pem`})
+	examples = append(examples, []string{`SOCKS5 proxy for users in users.ini to SSH on 10.0.0.0/8 and HTTPS on *.corp.example.com; Duo push to each user`, `gofwd -f 1.2.3.4:1080 --socks5 --proxy-allow 10.0.0.0/8:22,*.corp.example.com:443 --proxy-users users.ini --duo duo.ini:x --duo-identity-user`})
+	examples = append(examples, []string{`HTTP CONNECT proxy for git and curl, only to GitHub over HTTPS`, `gofwd -f 1.2.3.4:3128 --http-connect --proxy-allow github.com:443,*.github.com:443 --proxy-users users.ini`})
+	examples = append(examples, []string{`forward WireGuard (UDP), one Duo auth per new client session`, `gofwd --proto udp -f 1.2.3.4:51820 -t 192.168.1.1:51820 --duo duo.ini:testuser`})
+	examples = append(examples, []string{`forward the passive-mode FTP ports one to one, a single Duo push for all of them`, `gofwd -f 1.2.3.4:30000-30100 -t 192.168.1.1:30000-30100 --duo duo.ini:testuser`})
+	examples = append(examples, []string{`expose the local Docker socket over TCP, Duo push before each connection`, `gofwd -f 1.2.3.4:2375 -t unix:/var/run/docker.sock --duo duo.ini:testuser`})
+	examples = append(examples, []string{`serve every rule defined in an ini file from a single process`, `gofwd --config gofwd.ini`})
+	examples = append(examples, []string{`serve Prometheus metrics on localhost`, `gofwd -f 1.2.3.4:22 -t 192.168.1.1:22 --metrics-listen 127.0.0.1:9100`})
 	examples = append(examples, []string{`forward from any interface on port 22, allow RFC1918 to connect`, `gofwd -f 0.0.0.0:22 -t 192.168.1.1:22 -p`})
 	examples = append(examples, []string{`forward from IP address bounded to eth0, allow RFC1918 to connect`, `gofwd -f _eth0:22 -t 192.168.1.1:22 -p`})
+	examples = append(examples, []string{`forward from the IPv6 address bounded to eth0 to an IPv6 server`, `gofwd -f _eth0/6:22 -t [2001:db8::10]:22`})
+	examples = append(examples, []string{`forward from all IPv6 interfaces, allow unique local and link-local IPv6 to connect`, `gofwd -f [::]:22 -t 192.168.1.1:22 -p -A 2001:db8:1::/48`})
 	examples = append(examples, []string{`forward from IP address bounded to eno1, allow RFC1918 to connect`, `gofwd -f _eno1:80 -t example.com:80 -p`})
 
 	return examples
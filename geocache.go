@@ -0,0 +1,171 @@
+/*
+geocache.go
+
+An in-memory LRU cache of Geo IP lookups so that reconnects from the same IP address
+do not trigger another query (and eventually ipinfo.io's rate limit).
+Failed lookups are cached as well, but for a shorter time.
+*/
+
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// geoCacheRecord is a single cached lookup; exported fields so that it can be saved to disk
+type geoCacheRecord struct {
+	IP        string
+	Result    ipInfoResult
+	Provider  string
+	Fallbacks []string
+	Err       string
+	Expires   time.Time
+}
+
+type geoCache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	path        string
+	dirty       bool
+	order       *list.List
+	entries     map[string]*list.Element
+}
+
+func newGeoCache(maxEntries int, ttl time.Duration, negativeTTL time.Duration, path string) *geoCache {
+	return &geoCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxEntries,
+		path:        path,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the cached record for ip; ok is false when ip is not cached or has expired
+func (c *geoCache) get(ip string) (geoCacheRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[ip]
+	if !found {
+		return geoCacheRecord{}, false
+	}
+	record := elem.Value.(*geoCacheRecord)
+	if time.Now().After(record.Expires) {
+		c.order.Remove(elem)
+		delete(c.entries, ip)
+		c.dirty = true
+		return geoCacheRecord{}, false
+	}
+	c.order.MoveToFront(elem)
+	return *record, true
+}
+
+// put stores a lookup; err is the lookup error and selects the negative TTL
+func (c *geoCache) put(ip string, lookup geoLookup, err error) {
+	ttl := c.ttl
+	record := &geoCacheRecord{IP: ip, Result: lookup.result, Provider: lookup.provider, Fallbacks: lookup.fallbacks}
+	if err != nil {
+		ttl = c.negativeTTL
+		record.Err = err.Error()
+	}
+	if ttl <= 0 {
+		return
+	}
+	record.Expires = time.Now().Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insert(record)
+	c.dirty = true
+}
+
+// insert adds or replaces a record and evicts the least recently used ones; c.mu must be held
+func (c *geoCache) insert(record *geoCacheRecord) {
+	if elem, found := c.entries[record.IP]; found {
+		elem.Value = record
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[record.IP] = c.order.PushFront(record)
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*geoCacheRecord).IP)
+	}
+}
+
+// load reads previously saved records; expired records are skipped
+func (c *geoCache) load() error {
+	if 0 == len(c.path) {
+		return nil
+	}
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read geo-ip cache file '%s': %s", c.path, err)
+	}
+
+	var records []*geoCacheRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("Invalid geo-ip cache file '%s': %s", c.path, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// records are saved most recently used first
+	for i := len(records) - 1; i >= 0; i-- {
+		if now.Before(records[i].Expires) {
+			c.insert(records[i])
+		}
+	}
+	return nil
+}
+
+// save writes all records to disk when anything changed since the last save
+func (c *geoCache) save() error {
+	if 0 == len(c.path) {
+		return nil
+	}
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	records := make([]*geoCacheRecord, 0, c.order.Len())
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		records = append(records, elem.Value.(*geoCacheRecord))
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("Unable to write geo-ip cache file '%s': %s", tmp, err)
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// saveEvery periodically persists the cache until the process exits
+func (c *geoCache) saveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		errHandler(c.save(), false)
+	}
+}
@@ -10,6 +10,9 @@ import (
 	"strings"
 )
 
+// ipInfoClient is used for all ipinfo.io queries; its Timeout is set from --geoip-timeout
+var ipInfoClient = &http.Client{}
+
 // This is the format returned by: https://ipinfo.io/w.x.y.z/json
 type ipInfoResult struct {
 	IP       string
@@ -21,7 +24,7 @@ type ipInfoResult struct {
 	Postal   string
 	Org      string
 	Distance float64
-	ErrMsg   error
+	ErrMsg   error `json:"-"`
 }
 
 /*
@@ -36,6 +39,11 @@ Returns:
 	an ipInfoResult struct containing the information returned by the service
 */
 func getIPInfo(ip string) (ipInfoResult, error) {
+	return queryIPInfo(ip, "")
+}
+
+// queryIPInfo is the same as getIPInfo, but uses an ipinfo.io API token when one is given
+func queryIPInfo(ip string, token string) (ipInfoResult, error) {
 	var obj ipInfoResult
 
 	api := "/json"
@@ -43,8 +51,15 @@ func getIPInfo(ip string) (ipInfoResult, error) {
 		api = "json"
 	}
 	url := "https://ipinfo.io/" + ip + api
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return obj, err
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 	// #nosec G107 -- ip has been validated
-	resp, err := http.Get(url)
+	resp, err := ipInfoClient.Do(req)
 	if err != nil {
 		return obj, err
 	}
@@ -55,12 +70,18 @@ func getIPInfo(ip string) (ipInfoResult, error) {
 		return obj, err
 	}
 
-	if strings.Contains(string(body), "Rate limit exceeded") {
+	if resp.StatusCode == http.StatusTooManyRequests || strings.Contains(string(body), "Rate limit exceeded") {
 		err := fmt.Errorf("Error for '%s', %s", url, string(body))
 		empty := ipInfoResult{}
 		return empty, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("Error for '%s', %s", url, resp.Status)
+		empty := ipInfoResult{}
+		return empty, err
+	}
+
 	err = json.Unmarshal(body, &obj)
 	if err != nil {
 		empty := ipInfoResult{}
@@ -73,9 +94,6 @@ func getIPInfo(ip string) (ipInfoResult, error) {
 func validateLocation(localGeoIP ipInfoResult, remoteGeoIP ipInfoResult, restrictionsGeoIP ipInfoResult) (string, string) {
 	var distanceCalc string
 
-	if 0 == len(localGeoIP.Loc) {
-		return fmt.Sprintf("localGeoIP '%s' does not have lat,lon", localGeoIP.IP), ""
-	}
 	if 0 == len(remoteGeoIP.Loc) {
 		return fmt.Sprintf("remoteGeoIP '%s' does not have lat,lon", remoteGeoIP.IP), ""
 	}
@@ -96,6 +114,9 @@ func validateLocation(localGeoIP ipInfoResult, remoteGeoIP ipInfoResult, restric
 				return "restrictions.GeoIP-LatLon coordinates", ""
 			}
 		} else { // distance only
+			if 0 == len(localGeoIP.Loc) {
+				return fmt.Sprintf("localGeoIP '%s' does not have lat,lon", localGeoIP.IP), ""
+			}
 			lat2, lon2, err = latlon2coord(localGeoIP.Loc)
 			if err != nil {
 				return "localGeoIP-LatLon coordinates", ""
@@ -133,15 +154,18 @@ Returns:
 */
 func latlon2coord(latlon string) (float64, float64, error) {
 	slots := strings.Split(latlon, ",")
-	lat, err := strconv.ParseFloat(slots[0], 64)
+	if len(slots) != 2 {
+		return 0, 0, fmt.Errorf("Error converting location, expected LATITUDE,LONGITUDE: %s", latlon)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(slots[0]), 64)
 	if err != nil {
-		err = fmt.Errorf("Error converting latitude to float for: %s", latlon)
+		return 0, 0, fmt.Errorf("Error converting latitude to float for: %s", latlon)
 	}
-	lon, err := strconv.ParseFloat(slots[1], 64)
+	lon, err := strconv.ParseFloat(strings.TrimSpace(slots[1]), 64)
 	if err != nil {
-		err = fmt.Errorf("Error converting longitude to float for: %s", latlon)
+		return 0, 0, fmt.Errorf("Error converting longitude to float for: %s", latlon)
 	}
-	return lat, lon, err
+	return lat, lon, nil
 }
 
 // adapted from: https://gist.github.com/cdipaolo/d3f8db3848278b49db68
@@ -0,0 +1,273 @@
+/*
+geoprovider.go
+
+Geo IP information can come from several sources. Each source implements GeoProvider
+and they are consulted in order until one of them returns a result.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// GeoProvider returns the Geo IP information for a single IP address
+type GeoProvider interface {
+	Name() string
+	Lookup(ip string) (ipInfoResult, error)
+}
+
+// geoLookup is the outcome of a lookup through a geoProviderChain
+type geoLookup struct {
+	result    ipInfoResult
+	provider  string
+	fallbacks []string
+	cache     string
+}
+
+// String summarizes which provider answered, which ones failed before it and if the cache was used; used on ESTABLISHED / DENIED lines
+func (g geoLookup) String() string {
+	cache := ""
+	if len(g.cache) > 0 {
+		cache = fmt.Sprintf(" [cache %s]", g.cache)
+	}
+	if 0 == len(g.provider) {
+		return fmt.Sprintf("geo-ip: (none; tried %s)%s", strings.Join(g.fallbacks, ", "), cache)
+	}
+	if 0 == len(g.fallbacks) {
+		return fmt.Sprintf("geo-ip: %s%s", g.provider, cache)
+	}
+	return fmt.Sprintf("geo-ip: %s (fallback from %s)%s", g.provider, strings.Join(g.fallbacks, ", "), cache)
+}
+
+type geoProviderChain struct {
+	providers []GeoProvider
+	cache     *geoCache
+}
+
+/*
+Lookup tries each provider in order and returns the first successful result
+
+Args:
+
+	ip: an IPv4 or IPv6 address
+
+Returns:
+
+	the result along with the name of the provider that answered; the error of the last provider when all of them fail
+*/
+func (c *geoProviderChain) Lookup(ip string) (geoLookup, error) {
+	if c.cache == nil {
+		return c.lookupProviders(ip)
+	}
+
+	if record, ok := c.cache.get(ip); ok {
+		lookup := geoLookup{result: record.Result, provider: record.Provider, fallbacks: record.Fallbacks, cache: "hit"}
+		if len(record.Err) > 0 {
+			return lookup, errors.New(record.Err)
+		}
+		return lookup, nil
+	}
+
+	lookup, err := c.lookupProviders(ip)
+	c.cache.put(ip, lookup, err)
+	lookup.cache = "miss"
+	return lookup, err
+}
+
+func (c *geoProviderChain) lookupProviders(ip string) (geoLookup, error) {
+	var lookup geoLookup
+	var err error
+	for _, provider := range c.providers {
+		var result ipInfoResult
+		start := time.Now()
+		result, err = provider.Lookup(ip)
+		metricGeoIPLatency.WithLabelValues(provider.Name()).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metricGeoIPErrors.WithLabelValues(provider.Name()).Inc()
+			logger.Debugf("[%s] geo-ip provider %s failed: %s", ip, provider.Name(), err)
+			lookup.fallbacks = append(lookup.fallbacks, provider.Name())
+			continue
+		}
+		lookup.result = result
+		lookup.provider = provider.Name()
+		return lookup, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("[%s] no geo-ip provider configured", ip)
+	}
+	return lookup, err
+}
+
+// usesIPInfo returns true when ipinfo.io is one of the providers; only ipinfo.io can look up our own public address
+func (c *geoProviderChain) usesIPInfo() bool {
+	for _, provider := range c.providers {
+		if _, ok := provider.(*ipInfoProvider); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ipInfoProvider queries https://ipinfo.io; a token raises the free daily request limit
+type ipInfoProvider struct {
+	token string
+}
+
+func (p *ipInfoProvider) Name() string {
+	return "ipinfo"
+}
+
+func (p *ipInfoProvider) Lookup(ip string) (ipInfoResult, error) {
+	return queryIPInfo(ip, p.token)
+}
+
+// staticGeoEntry is one section of a static override file
+type staticGeoEntry struct {
+	network *net.IPNet
+	result  ipInfoResult
+}
+
+// staticProvider returns fixed Geo IP information for the networks listed in an ini file
+type staticProvider struct {
+	path    string
+	entries []staticGeoEntry
+}
+
+/*
+loadStaticProvider reads an ini file where each section name is a CIDR network, for example:
+
+	[203.0.113.0/24]
+	city=Denver
+	region=Colorado
+	country=US
+	loc=39.7392,-104.9903
+	postal=80202
+	org=AS64500 Example Networks
+
+The first section containing the IP address wins.
+*/
+func loadStaticProvider(path string) (*staticProvider, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read file: %v", err)
+	}
+
+	provider := &staticProvider{path: path}
+	for _, section := range cfg.Sections() {
+		if ini.DefaultSection == section.Name() {
+			continue
+		}
+		_, network, err := net.ParseCIDR(section.Name())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR network in %s: %s", path, section.Name())
+		}
+		result := ipInfoResult{
+			City:    section.Key("city").String(),
+			Region:  section.Key("region").String(),
+			Country: section.Key("country").String(),
+			Loc:     section.Key("loc").String(),
+			Postal:  section.Key("postal").String(),
+			Org:     section.Key("org").String(),
+		}
+		if len(result.Loc) > 0 {
+			if _, _, err := latlon2coord(result.Loc); err != nil {
+				return nil, fmt.Errorf("[%s] invalid loc in %s: %s", section.Name(), path, err)
+			}
+		}
+		provider.entries = append(provider.entries, staticGeoEntry{network: network, result: result})
+	}
+	return provider, nil
+}
+
+func (p *staticProvider) Name() string {
+	return "static"
+}
+
+func (p *staticProvider) Lookup(ip string) (ipInfoResult, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ipInfoResult{}, fmt.Errorf("Invalid IP address: '%s'", ip)
+	}
+	for _, entry := range p.entries {
+		if entry.network.Contains(addr) {
+			result := entry.result
+			result.IP = ip
+			return result, nil
+		}
+	}
+	return ipInfoResult{}, fmt.Errorf("Error for '%s': not found in %s", ip, p.path)
+}
+
+/*
+newGeoProviderChain builds the ordered list of Geo IP providers
+
+Args:
+
+	order: comma delimited provider names: ipinfo, mmdb, ip2location, static; when empty, every
+	configured file based provider is used (static, mmdb, ip2location) and ipinfo only when there are none
+
+	token: ipinfo.io API token, may be empty
+
+	mmdbFile, csvFile, staticFile: paths for the file based providers, may be empty
+
+Returns:
+
+	the provider chain, or an error if a provider is unknown or can not be loaded
+*/
+func newGeoProviderChain(order string, token string, mmdbFile string, csvFile string, staticFile string) (*geoProviderChain, error) {
+	if 0 == len(order) {
+		var names []string
+		if len(staticFile) > 0 {
+			names = append(names, "static")
+		}
+		if len(mmdbFile) > 0 {
+			names = append(names, "mmdb")
+		}
+		if len(csvFile) > 0 {
+			names = append(names, "ip2location")
+		}
+		if 0 == len(names) {
+			names = append(names, "ipinfo")
+		}
+		order = strings.Join(names, ",")
+	}
+
+	chain := &geoProviderChain{}
+	for _, name := range strings.Split(order, ",") {
+		var provider GeoProvider
+		var err error
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "ipinfo":
+			provider = &ipInfoProvider{token: token}
+		case "mmdb":
+			if 0 == len(mmdbFile) {
+				return nil, fmt.Errorf("geo-ip provider 'mmdb' requires --geoip-db")
+			}
+			provider, err = openMMDB(mmdbFile)
+		case "ip2location":
+			if 0 == len(csvFile) {
+				return nil, fmt.Errorf("geo-ip provider 'ip2location' requires --geoip-csv")
+			}
+			provider, err = loadIP2LocationCSV(csvFile)
+		case "static":
+			if 0 == len(staticFile) {
+				return nil, fmt.Errorf("geo-ip provider 'static' requires --geoip-static")
+			}
+			provider, err = loadStaticProvider(staticFile)
+		default:
+			return nil, fmt.Errorf("Unknown geo-ip provider: '%s'", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain.providers = append(chain.providers, provider)
+	}
+	return chain, nil
+}
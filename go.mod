@@ -5,14 +5,27 @@ go 1.21.1
 require (
 	github.com/alecthomas/kingpin/v2 v2.3.2
 	github.com/duosecurity/duo_api_golang v0.0.0-20230418202038-096d3306c029
+	github.com/maxmind/mmdbwriter v1.0.0
 	github.com/olekukonko/tablewriter v0.0.5
+	github.com/oschwald/maxminddb-golang v1.12.0
+	github.com/prometheus/client_golang v1.17.0
 	go.uber.org/zap v1.26.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
 require (
 	github.com/alecthomas/units v0.0.0-20211218093645-b94a6e3cc137 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/prometheus/client_model v0.4.1-0.20230718164431-9a2bf3000d16 // indirect
+	github.com/prometheus/common v0.44.0 // indirect
+	github.com/prometheus/procfs v0.11.1 // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
+	go4.org/netipx v0.0.0-20220812043211-3cc044ffd68d // indirect
+	golang.org/x/sys v0.11.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
@@ -0,0 +1,124 @@
+/*
+health.go
+
+Active health checks for the backends of a rule. Every --health-interval seconds each
+backend is probed: a TCP connect, optionally followed by sending --health-send and
+waiting for a reply that contains --health-expect (eg: SSH-2.0). While no backend is
+healthy, new connections are denied before any geo-ip or Duo checks are made.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheck describes how the backends of a rule are probed; a zero interval disables it
+type healthCheck struct {
+	interval time.Duration
+	timeout  time.Duration
+	send     string
+	expect   string
+}
+
+// healthEscapes allows line endings to be given in --health-send and --health-expect
+var healthEscapes = strings.NewReplacer(`\r`, "\r", `\n`, "\n")
+
+// probe checks a single backend
+func (hc healthCheck) probe(proto string, address string) error {
+	network, address := dialNetwork(proto, address)
+	conn, err := net.DialTimeout(network, address, hc.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hc.timeout))
+
+	if len(hc.send) > 0 {
+		if _, err := conn.Write([]byte(healthEscapes.Replace(hc.send))); err != nil {
+			return err
+		}
+	}
+	if 0 == len(hc.expect) {
+		return nil
+	}
+
+	expect := []byte(healthEscapes.Replace(hc.expect))
+	var received []byte
+	buf := make([]byte, 512)
+	for len(received) < 4096 {
+		n, err := conn.Read(buf)
+		received = append(received, buf[:n]...)
+		if bytes.Contains(received, expect) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return errors.New("expected reply not received: " + hc.expect)
+}
+
+/*
+startHealthChecks probes every backend of the pool right away and then every interval,
+until stopHealthChecks is called. Nothing is started when health checks are disabled.
+*/
+func (p *backendPool) startHealthChecks() {
+	if 0 == p.check.interval {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.check.interval)
+		defer ticker.Stop()
+		for {
+			var wg sync.WaitGroup
+			for _, b := range p.backends {
+				wg.Add(1)
+				go func(b *backend) {
+					defer wg.Done()
+					p.setHealth(b, p.check.probe(p.proto, b.address))
+				}(b)
+			}
+			wg.Wait()
+
+			select {
+			case <-p.stopHealth:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopHealthChecks ends the health checks of a pool that is no longer used; it is safe to call more than once
+func (p *backendPool) stopHealthChecks() {
+	p.stopOnce.Do(func() { close(p.stopHealth) })
+}
+
+// setHealth records the result of a probe and logs when a backend changes state
+func (p *backendPool) setHealth(b *backend, err error) {
+	if err != nil {
+		if !b.unhealthy.Swap(true) {
+			logger.Warnf("[%s] backend %s is unhealthy: %s", p.name, b.address, err)
+		}
+		return
+	}
+	if b.unhealthy.Swap(false) {
+		logger.Infof("[%s] backend %s is healthy again", p.name, b.address)
+	}
+}
+
+// healthy returns false when every backend has failed its last health check
+func (p *backendPool) healthy() bool {
+	for _, b := range p.backends {
+		if !b.unhealthy.Load() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+/*
+httpconnect.go
+
+HTTP CONNECT proxy mode, see proxy.go; for tools that can only use an HTTP proxy, eg: git, curl
+or an IDE. With --proxy-users, clients log in with Proxy-Authorization: Basic. The response to
+CONNECT is only sent once the client has been admitted and the destination is connected.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maximum time a client has to send its CONNECT request
+const httpConnectTimeout = 30 * time.Second
+
+// httpReply sends a response without a body; header lines must end in \r\n
+func httpReply(conn net.Conn, status int, header string) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status), header)
+	return err
+}
+
+/*
+readConnectRequest reads the client's CONNECT request and checks its credentials
+
+Returns:
+
+	the identity of the client (nil without --proxy-users), the requested host and port,
+	or an error; failures that the client should know about have already been answered
+*/
+func (pc *proxyConfig) readConnectRequest(conn net.Conn, r *bufio.Reader) (*clientIdentity, string, int, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		httpReply(conn, http.StatusBadRequest, "")
+		return nil, "", 0, fmt.Errorf("invalid HTTP request: %s", err)
+	}
+	if http.MethodConnect != req.Method {
+		httpReply(conn, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+		return nil, "", 0, fmt.Errorf("unsupported HTTP method: %s", req.Method)
+	}
+
+	var identity *clientIdentity
+	if pc.users != nil {
+		// ReadRequest only parses Authorization, so Proxy-Authorization is moved there to be decoded
+		req.Header.Set("Authorization", req.Header.Get("Proxy-Authorization"))
+		user, password, ok := req.BasicAuth()
+		if !ok || !pc.checkPassword(user, password) {
+			httpReply(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"gofwd\"\r\n")
+			if !ok {
+				return nil, "", 0, errors.New("HTTP CONNECT without Proxy-Authorization")
+			}
+			return nil, "", 0, fmt.Errorf("HTTP CONNECT authentication failed for user: %q", user)
+		}
+		identity = &clientIdentity{source: "proxy", name: user}
+	}
+
+	host, portText, err := net.SplitHostPort(req.Host)
+	port, portErr := strconv.Atoi(portText)
+	if err != nil || portErr != nil || port < 1 || port > 65535 {
+		httpReply(conn, http.StatusBadRequest, "")
+		return identity, "", 0, fmt.Errorf("invalid HTTP CONNECT destination: %q", req.Host)
+	}
+	return identity, host, port, nil
+}
+
+/*
+httpConnectForward handles a client of an --http-connect rule: CONNECT request, destination and
+admission checks, then the connection to the destination
+
+Args:
+
+	src: the client connection
+
+	rule: the rule of the listener
+
+	queue: the admission workers; only the admission checks take one
+*/
+func httpConnectForward(src net.Conn, rule *forwardRule, queue *admissionQueue) {
+	if err := src.SetDeadline(time.Now().Add(httpConnectTimeout)); err != nil {
+		src.Close()
+		return
+	}
+	r := bufio.NewReader(src)
+	identity, host, port, err := rule.proxy.readConnectRequest(src, r)
+	if err != nil {
+		logger.Warnf("[%v] DENIED; %s", src.RemoteAddr(), err)
+		metricDenied.WithLabelValues(rule.name, "http_connect_error").Inc()
+		src.Close()
+		return
+	}
+	// admission may wait for a Duo push, which is not bound by the request timeout
+	if err := src.SetDeadline(time.Time{}); err != nil {
+		errHandler(err, false)
+	}
+
+	dst, path, err := proxyConnect(src, rule, identity, host, port, queue)
+	src.SetWriteDeadline(time.Now().Add(httpConnectTimeout))
+	var netErr net.Error
+	switch {
+	case err == nil:
+	case errors.Is(err, errDestinationDenied), errors.Is(err, errAdmissionDenied):
+		httpReply(src, http.StatusForbidden, "")
+		src.Close()
+		return
+	case errors.As(err, &netErr) && netErr.Timeout():
+		httpReply(src, http.StatusGatewayTimeout, "")
+		src.Close()
+		return
+	default:
+		httpReply(src, http.StatusBadGateway, "")
+		src.Close()
+		return
+	}
+
+	if _, err := fmt.Fprint(src, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		errHandler(err, false)
+		src.Close()
+		dst.Close()
+		return
+	}
+	if err := src.SetWriteDeadline(time.Time{}); err != nil {
+		errHandler(err, false)
+	}
+	// the client may already have sent data after its request, eg: a TLS ClientHello
+	src = &replayConn{Conn: src, r: r}
+	forward(newForwardSession(src, dst, rule.name, path), rule, func() {})
+}
@@ -0,0 +1,136 @@
+/*
+ip2location.go
+
+Offline Geo IP lookups from an IP2Location LITE CSV file (DB1 through DB11, IPv4 or IPv6).
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+)
+
+// ip2locationRange is one row of the CSV file; addresses are stored in their 16 byte form
+type ip2locationRange struct {
+	from   [16]byte
+	to     [16]byte
+	result ipInfoResult
+}
+
+type ip2locationProvider struct {
+	path   string
+	ranges []ip2locationRange
+}
+
+/*
+ip2locationNumber converts a decimal IP number from the CSV file to its 16 byte form
+IPv4 files use 32 bit numbers which are converted to IPv4-mapped IPv6 addresses,
+the same convention that the IPv6 files use for IPv4 ranges.
+*/
+func ip2locationNumber(s string) ([16]byte, error) {
+	var addr [16]byte
+
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return addr, fmt.Errorf("Invalid IP number: '%s'", s)
+	}
+	if n.BitLen() <= 32 {
+		ip := net.IPv4(0, 0, 0, 0).To16()
+		n.FillBytes(ip[12:])
+		copy(addr[:], ip)
+		return addr, nil
+	}
+	n.FillBytes(addr[:])
+	return addr, nil
+}
+
+/*
+loadIP2LocationCSV reads the whole CSV file into memory
+
+The columns are: ip_from, ip_to, country_code, country_name, region_name, city_name,
+latitude, longitude, zip_code, time_zone; smaller databases only have a prefix of these.
+*/
+func loadIP2LocationCSV(path string) (*ip2locationProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open geo-ip csv file '%s': %s", path, err)
+	}
+	defer f.Close()
+
+	provider := &ip2locationProvider{path: path}
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", path, err)
+		}
+		if len(row) < 4 {
+			return nil, fmt.Errorf("Error reading %s: expected at least 4 columns, got %d", path, len(row))
+		}
+
+		var entry ip2locationRange
+		if entry.from, err = ip2locationNumber(row[0]); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", path, err)
+		}
+		if entry.to, err = ip2locationNumber(row[1]); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", path, err)
+		}
+		if "-" == row[2] {
+			// unallocated address space
+			continue
+		}
+		entry.result.Country = row[2]
+		if len(row) >= 6 {
+			entry.result.Region = row[4]
+			entry.result.City = row[5]
+		}
+		if len(row) >= 8 {
+			entry.result.Loc = fmt.Sprintf("%s,%s", row[6], row[7])
+		}
+		if len(row) >= 9 && "-" != row[8] {
+			entry.result.Postal = row[8]
+		}
+		provider.ranges = append(provider.ranges, entry)
+	}
+
+	sort.Slice(provider.ranges, func(i, j int) bool {
+		return bytes.Compare(provider.ranges[i].from[:], provider.ranges[j].from[:]) < 0
+	})
+	return provider, nil
+}
+
+func (p *ip2locationProvider) Name() string {
+	return "ip2location"
+}
+
+func (p *ip2locationProvider) Lookup(ip string) (ipInfoResult, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ipInfoResult{}, fmt.Errorf("Invalid IP address: '%s'", ip)
+	}
+	var key [16]byte
+	copy(key[:], addr.To16())
+
+	// find the last range starting at or before the address
+	i := sort.Search(len(p.ranges), func(i int) bool {
+		return bytes.Compare(p.ranges[i].from[:], key[:]) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(key[:], p.ranges[i].to[:]) > 0 {
+		return ipInfoResult{}, fmt.Errorf("Error for '%s': not found in %s", ip, p.path)
+	}
+
+	result := p.ranges[i].result
+	result.IP = ip
+	return result, nil
+}
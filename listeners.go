@@ -0,0 +1,285 @@
+/*
+listeners.go
+
+The forwarder owns one listening socket per rule. The rule attached to a socket
+can be swapped at any time (SIGHUP), so connections that are already being
+forwarded are never touched by a configuration reload.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ruleListener is a listening socket together with the rule that currently applies to it
+type ruleListener struct {
+	key    string
+	rule   atomic.Pointer[forwardRule]
+	routes atomic.Pointer[sniRoutes]
+	stream net.Listener
+	udp    *udpForwarder
+	closer io.Closer
+}
+
+// setRules stores the rules of a listener: a single rule, or the SNI routes that share it; the first rule is used for the listener itself
+func (rl *ruleListener) setRules(group []*forwardRule) {
+	rl.rule.Store(group[0])
+	if len(group[0].sni) > 0 {
+		rl.routes.Store(&sniRoutes{rules: group})
+	} else {
+		rl.routes.Store(nil)
+	}
+}
+
+// rules returns every rule of the listener
+func (rl *ruleListener) rules() []*forwardRule {
+	if routes := rl.routes.Load(); routes != nil {
+		return routes.rules
+	}
+	return []*forwardRule{rl.rule.Load()}
+}
+
+// ruleKey identifies a listening socket; two rules can not share one
+func ruleKey(proto string, from string) string {
+	return proto + "/" + from
+}
+
+// openRuleListener binds the rule's listening socket without accepting any connections yet
+func openRuleListener(rule *forwardRule) (*ruleListener, error) {
+	rl := &ruleListener{key: ruleKey(rule.proto, rule.from)}
+	rl.rule.Store(rule)
+
+	if "udp" == rule.proto {
+		fromAddress, err := net.ResolveUDPAddr(rule.proto, rule.from)
+		if err != nil {
+			return nil, err
+		}
+		listener, err := net.ListenUDP(rule.proto, fromAddress)
+		if err != nil {
+			return nil, err
+		}
+		rl.udp = newUDPForwarder(listener, rl)
+		rl.closer = listener
+		return rl, nil
+	}
+
+	if path, ok := unixSocketPath(rule.from); ok {
+		listener, err := listenUnix(path, rule.unixMode)
+		if err != nil {
+			return nil, err
+		}
+		rl.stream = listener
+		rl.closer = listener
+		return rl, nil
+	}
+
+	fromAddress, err := net.ResolveTCPAddr(rule.proto, rule.from)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP(rule.proto, fromAddress)
+	if err != nil {
+		return nil, err
+	}
+	rl.stream = listener
+	rl.closer = listener
+	return rl, nil
+}
+
+// serve accepts connections (or packets) until the listener is closed
+func (rl *ruleListener) serve(queue *admissionQueue) {
+	rule := rl.rule.Load()
+	if rl.udp != nil {
+		logger.Infof("[%s] Forwarding to [%s] [%s]; idle timeout: %v", rule.from, rule.proto, rule.to, rule.udpTimeout)
+		rl.udp.serve(queue)
+		return
+	}
+	for _, route := range rl.rules() {
+		if route.proxy != nil {
+			logger.Infof("[%s] %s proxy to [%s] [%s]", route.from, route.proxy.mode, route.proto, route.proxy.allowList)
+		} else if len(route.sni) > 0 {
+			logger.Infof("[%s] Forwarding [%s] to [%s] [%s]", route.from, route.sni, route.proto, route.to)
+		} else {
+			logger.Infof("[%s] Forwarding to [%s] [%s]", route.from, route.proto, route.to)
+		}
+	}
+	tcpStart(rl.stream, rl, queue)
+}
+
+type forwarder struct {
+	mu        sync.Mutex
+	queue     *admissionQueue
+	geo       *geoProviderChain
+	selfGeoIP *ipInfoResult
+	listeners map[string]*ruleListener
+}
+
+func newForwarder(queue *admissionQueue, geo *geoProviderChain, selfGeoIP *ipInfoResult) *forwarder {
+	return &forwarder{
+		queue:     queue,
+		geo:       geo,
+		selfGeoIP: selfGeoIP,
+		listeners: make(map[string]*ruleListener),
+	}
+}
+
+/*
+apply makes rules the active configuration
+
+New listeners are opened before anything else is changed; if one of them can not be
+opened, the previous configuration stays in place. Rules for listeners that already
+exist are swapped in place and listeners without a rule are closed. In both cases,
+connections that have already been forwarded keep running. Rules with the same
+listening address are SNI routes of a single listener.
+*/
+func (f *forwarder) apply(rules []*forwardRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	groups := make(map[string][]*forwardRule)
+	var keys []string
+	for _, rule := range rules {
+		key := ruleKey(rule.proto, rule.from)
+		if _, found := groups[key]; !found {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], rule)
+	}
+
+	opened := make(map[string]*ruleListener)
+	for _, key := range keys {
+		if _, found := f.listeners[key]; found {
+			continue
+		}
+		rule := groups[key][0]
+		rl, err := openRuleListener(rule)
+		if err != nil {
+			for _, o := range opened {
+				o.closer.Close()
+			}
+			return fmt.Errorf("[%s] %s", rule.name, err)
+		}
+		rl.setRules(groups[key])
+		opened[key] = rl
+	}
+
+	for _, key := range keys {
+		rl, found := f.listeners[key]
+		if !found {
+			continue
+		}
+		oldRules := rl.rules()
+		for _, rule := range groups[key] {
+			for _, old := range oldRules {
+				if old.name == rule.name {
+					keepDuoState(old, rule)
+					keepBackendState(old, rule)
+				}
+			}
+		}
+		rl.setRules(groups[key])
+		for _, rule := range groups[key] {
+			if !usesBackends(oldRules, rule.backends) {
+				rule.backends.startHealthChecks()
+			}
+			logger.Infof("[%s] rule updated for [%s] [%s]", rule.name, rule.proto, rule.from)
+		}
+		for _, old := range oldRules {
+			if !usesBackends(groups[key], old.backends) {
+				old.backends.stopHealthChecks()
+			}
+		}
+	}
+
+	for key, rl := range f.listeners {
+		if _, found := groups[key]; found {
+			continue
+		}
+		rl.closer.Close()
+		for _, rule := range rl.rules() {
+			rule.backends.stopHealthChecks()
+		}
+		delete(f.listeners, key)
+		logger.Infof("[%s] listener removed for [%s] [%s]", rl.rule.Load().name, rl.rule.Load().proto, rl.rule.Load().from)
+	}
+
+	for key, rl := range opened {
+		f.listeners[key] = rl
+		for _, rule := range rl.rules() {
+			rule.backends.startHealthChecks()
+		}
+		go rl.serve(f.queue)
+	}
+	return nil
+}
+
+// usesBackends returns true when one of rules forwards to pool
+func usesBackends(rules []*forwardRule, pool *backendPool) bool {
+	for _, rule := range rules {
+		if rule.backends == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// reload re-reads the configuration; an invalid configuration is logged and the current one is kept
+func (f *forwarder) reload() {
+	logger.Infof("Reloading configuration")
+	configs, err := loadRuleConfigs()
+	if err == nil {
+		var rules []*forwardRule
+		rules, err = buildRules(configs, f.geo, f.selfGeoIP)
+		if err == nil {
+			err = f.apply(rules)
+		}
+	}
+	if err != nil {
+		logger.Warnf("Reload rejected, keeping the previous configuration: %s", err)
+		return
+	}
+	logger.Infof("Reload complete")
+}
+
+// shutdown stops accepting new connections and then drains the forwarded ones
+func (f *forwarder) shutdown(drainTimeout time.Duration) {
+	f.mu.Lock()
+	for key, rl := range f.listeners {
+		rl.closer.Close()
+		delete(f.listeners, key)
+	}
+	f.mu.Unlock()
+
+	logger.Infof("Shutdown: no longer accepting connections; waiting up to %v for forwarded connections to finish", drainTimeout)
+	drained, killed := activeSessions.drain(drainTimeout)
+	logger.Infof("Shutdown: %d sessions drained, %d sessions killed", drained, killed)
+}
+
+// keepDuoState lets a reloaded rule reuse the Duo cache of the rule it replaces when the Duo settings did not change
+func keepDuoState(old *forwardRule, rule *forwardRule) {
+	if old.policy.duo == nil || rule.policy.duo == nil {
+		return
+	}
+	if u, v := old.policy.duoUsers, rule.policy.duoUsers; u != nil && v != nil && u.file == v.file && u.cacheTime == v.cacheTime && u.timeout == v.timeout {
+		rule.policy.duoUsers = u
+	}
+	a, b := old.policy.duo, rule.policy.duo
+	if a.cred.name == b.cred.name && a.cred.integration == b.cred.integration && a.cred.secret == b.cred.secret &&
+		a.cred.hostname == b.cred.hostname && a.cacheTime == b.cacheTime && a.timeout == b.timeout {
+		rule.policy.duo = a
+	}
+}
+
+// keepBackendState lets a reloaded rule keep the connection counts, down state and health checks of its backends when they did not change
+func keepBackendState(old *forwardRule, rule *forwardRule) {
+	a, b := old.backends, rule.backends
+	if old.to == rule.to && a.proto == b.proto && a.mode == b.mode && a.maxFails == b.maxFails && a.cooldown == b.cooldown && a.check == b.check {
+		rule.backends = a
+	}
+}
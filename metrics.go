@@ -0,0 +1,82 @@
+/*
+metrics.go
+
+Prometheus metrics, served over HTTP at /metrics when --metrics-listen is given.
+The listener label is the rule name, so that multi-rule setups can be told apart.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gofwd_connections_accepted_total",
+		Help: "Connections that passed admission, by reason: allow_cidr, geo, identity, unix, duo, duo_cached.",
+	}, []string{"listener", "reason"})
+
+	metricDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gofwd_connections_denied_total",
+		Help: "Connections that were refused, by reason: deny_cidr, geo_error, geo_mismatch, distance, duo_denied, identity_denied, destination_denied, proxy_error, queue_full, socks_error, http_connect_error, sni_error, sni_unknown, tls_error, unhealthy, upstream_error, upstream_tls_error, shutdown.",
+	}, []string{"listener", "reason"})
+
+	metricActiveSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gofwd_sessions_active",
+		Help: "Connections, and UDP sessions, that are currently being forwarded.",
+	}, []string{"listener"})
+
+	metricBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gofwd_bytes_total",
+		Help: "Bytes forwarded; direction is 'in' for client to upstream and 'out' for upstream to client.",
+	}, []string{"listener", "direction"})
+
+	metricGeoIPLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gofwd_geoip_lookup_seconds",
+		Help:    "Duration of geo-ip lookups, by provider.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"})
+
+	metricGeoIPErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gofwd_geoip_lookup_errors_total",
+		Help: "Failed geo-ip lookups, by provider.",
+	}, []string{"provider"})
+
+	metricDuoLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gofwd_duo_push_seconds",
+		Help:    "Time until a Duo push was answered, by result: allow, deny.",
+		Buckets: []float64{1, 2.5, 5, 10, 15, 20, 30, 45, 60, 90},
+	}, []string{"listener", "result"})
+)
+
+// metricsStart serves /metrics on address; a failure to listen is fatal
+func metricsStart(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	logger.Infof("Serving metrics on http://%s/metrics", address)
+	// #nosec G114 -- metrics only, no request bodies are read
+	errHandler(http.ListenAndServe(address, mux), true)
+}
+
+// meteredReader adds the number of bytes read to a counter and to the session's total as they are read
+type meteredReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+	total   *atomic.Int64
+}
+
+func (m meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if n > 0 {
+		m.counter.Add(float64(n))
+		m.total.Add(int64(n))
+	}
+	return n, err
+}
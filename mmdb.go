@@ -0,0 +1,109 @@
+/*
+mmdb.go
+
+Offline Geo IP lookups from a local MaxMind GeoLite2-City / DB-IP database in MMDB format.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbCityRecord contains the fields of a GeoLite2-City / DB-IP City record that map onto an ipInfoResult
+type mmdbCityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Traits struct {
+		Organization string `maxminddb:"organization"`
+		ISP          string `maxminddb:"isp"`
+	} `maxminddb:"traits"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+type mmdbReader struct {
+	path string
+	db   *maxminddb.Reader
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open geo-ip database '%s': %s", path, err)
+	}
+	return &mmdbReader{path: path, db: db}, nil
+}
+
+/*
+Lookup searches the database for the given IP address
+The database record is converted to an ipInfoResult struct, using the same conventions as ipinfo.io
+Args:
+
+	ip: an IPv4 or IPv6 address
+
+Returns:
+
+	an ipInfoResult struct containing the information found in the database
+*/
+func (m *mmdbReader) Lookup(ip string) (ipInfoResult, error) {
+	var record mmdbCityRecord
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ipInfoResult{}, fmt.Errorf("Invalid IP address: '%s'", ip)
+	}
+
+	_, ok, err := m.db.LookupNetwork(addr, &record)
+	if err != nil {
+		return ipInfoResult{}, fmt.Errorf("Error for '%s' in %s: %s", ip, m.path, err)
+	}
+	if !ok {
+		return ipInfoResult{}, fmt.Errorf("Error for '%s': not found in %s", ip, m.path)
+	}
+
+	obj := ipInfoResult{
+		IP:      ip,
+		City:    record.City.Names["en"],
+		Country: record.Country.ISOCode,
+		Postal:  record.Postal.Code,
+	}
+	if record.Location.Latitude != 0 || record.Location.Longitude != 0 {
+		obj.Loc = fmt.Sprintf("%.4f,%.4f", record.Location.Latitude, record.Location.Longitude)
+	}
+	if len(record.Subdivisions) > 0 {
+		obj.Region = record.Subdivisions[0].Names["en"]
+	}
+
+	switch {
+	case record.AutonomousSystemNumber > 0:
+		obj.Org = fmt.Sprintf("AS%d %s", record.AutonomousSystemNumber, record.AutonomousSystemOrganization)
+	case len(record.Traits.Organization) > 0:
+		obj.Org = record.Traits.Organization
+	default:
+		obj.Org = record.Traits.ISP
+	}
+
+	return obj, nil
+}
+
+func (m *mmdbReader) Name() string {
+	return "mmdb"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// writeTestMMDB generates a small GeoLite2-City style database with one IPv4 and one IPv6 network
+func writeTestMMDB(t *testing.T) string {
+	t.Helper()
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "GeoLite2-City", IncludeReservedNetworks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string]mmdbtype.Map{
+		"192.0.2.0/24": {
+			"city":         mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String("Denver")}},
+			"subdivisions": mmdbtype.Slice{mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String("Colorado")}}},
+			"country":      mmdbtype.Map{"iso_code": mmdbtype.String("US")},
+			"location":     mmdbtype.Map{"latitude": mmdbtype.Float64(39.7392), "longitude": mmdbtype.Float64(-104.9847)},
+			"postal":       mmdbtype.Map{"code": mmdbtype.String("80202")},
+
+			"autonomous_system_number":       mmdbtype.Uint32(64500),
+			"autonomous_system_organization": mmdbtype.String("Example Networks"),
+		},
+		"2001:db8::/32": {
+			"city":         mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String("Toronto")}},
+			"subdivisions": mmdbtype.Slice{mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String("Ontario")}}},
+			"country":      mmdbtype.Map{"iso_code": mmdbtype.String("CA")},
+			"location":     mmdbtype.Map{"latitude": mmdbtype.Float64(43.6532), "longitude": mmdbtype.Float64(-79.3832)},
+			"postal":       mmdbtype.Map{"code": mmdbtype.String("M5H")},
+			"traits":       mmdbtype.Map{"organization": mmdbtype.String("Example University")},
+		},
+	}
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := tree.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBLookup(t *testing.T) {
+	reader, err := openMMDB(writeTestMMDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.db.Close()
+
+	tests := []struct {
+		ip   string
+		want ipInfoResult
+	}{
+		{"192.0.2.10", ipInfoResult{IP: "192.0.2.10", City: "Denver", Region: "Colorado", Country: "US", Loc: "39.7392,-104.9847", Postal: "80202", Org: "AS64500 Example Networks"}},
+		{"2001:db8::1", ipInfoResult{IP: "2001:db8::1", City: "Toronto", Region: "Ontario", Country: "CA", Loc: "43.6532,-79.3832", Postal: "M5H", Org: "Example University"}},
+	}
+	for _, tt := range tests {
+		got, err := reader.Lookup(tt.ip)
+		if err != nil {
+			t.Errorf("Lookup(%s): %s", tt.ip, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := reader.Lookup("198.51.100.1"); err == nil {
+		t.Errorf("Lookup of an address that is not in the database did not fail")
+	}
+}
@@ -66,7 +66,7 @@ func extractIPAddrs(ifaceName string, allAddresses []net.Addr, brief bool) ([]st
 	return allIPv4, allIPv6
 }
 
-func getSpecificNic(adapter string) (string, error) {
+func getSpecificNic(adapter string, ipv6 bool) (string, error) {
 	adapters, err := net.Interfaces()
 	if err != nil {
 		return "", err
@@ -74,23 +74,79 @@ func getSpecificNic(adapter string) (string, error) {
 
 	adapter = strings.ToLower(adapter)
 	for _, iface := range adapters {
+		if strings.ToLower(iface.Name) != adapter {
+			continue
+		}
 		allAddresses, err := iface.Addrs()
 		if err != nil {
 			return "", err
 		}
 
-		allIPv4, _ := extractIPAddrs(iface.Name, allAddresses, true)
-		if len(allIPv4) == 1 && strings.ToLower(iface.Name) == adapter {
-			for _, ipWithMask := range allIPv4 {
-				ip := strings.Split(ipWithMask, "/")
+		allIPv4, allIPv6 := extractIPAddrs(iface.Name, allAddresses, true)
+		if !ipv6 {
+			if len(allIPv4) == 1 {
+				ip := strings.Split(allIPv4[0], "/")
 				return ip[0], nil
 			}
+			continue
+		}
+
+		// prefer a global address; a link-local address is only usable with its zone
+		linkLocal := ""
+		for _, ipWithMask := range allIPv6 {
+			ip := net.ParseIP(strings.Split(ipWithMask, "/")[0])
+			if ip == nil {
+				continue
+			}
+			if ip.IsGlobalUnicast() {
+				return ip.String(), nil
+			}
+			if ip.IsLinkLocalUnicast() && 0 == len(linkLocal) {
+				linkLocal = ip.String() + "%" + iface.Name
+			}
+		}
+		if len(linkLocal) > 0 {
+			return linkLocal, nil
 		}
 	}
 
 	return "", fmt.Errorf("Unknown adapter: '%s'. Use '-i' to list adapter names.", adapter)
 }
 
+/*
+resolveNicAddress replaces the adapter name in an address such as _eth0:22 with the adapter's IP address
+
+Args:
+
+	address: _adapter:port for the adapter's IPv4 address or _adapter/6:port for its IPv6 address
+
+Returns:
+
+	the address in host:port format, IPv6 addresses are enclosed in brackets
+*/
+func resolveNicAddress(address string) (string, error) {
+	pos := strings.LastIndex(address, ":")
+	if pos < 0 {
+		return "", fmt.Errorf("'%s' does not contain a ':' character", address)
+	}
+	adapter := strings.TrimPrefix(address[:pos], "_")
+	port := address[pos+1:]
+
+	ipv6 := false
+	if strings.HasSuffix(adapter, "/6") {
+		ipv6 = true
+		adapter = strings.TrimSuffix(adapter, "/6")
+	} else {
+		adapter = strings.TrimSuffix(adapter, "/4")
+	}
+
+	ip, err := getSpecificNic(adapter, ipv6)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip, port), nil
+}
+
 func networkInterfaces(brief bool, debug bool) ([]string, []string, error) {
 	adapters, err := net.Interfaces()
 	if err != nil {
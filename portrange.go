@@ -0,0 +1,105 @@
+/*
+portrange.go
+
+Port ranges, eg: for passive-mode FTP, RTP or game servers. --from 0.0.0.0:30000-30100 opens one
+listener per port. Each --to backend either has a range of the same size, mapping the ports one to
+one, or a single port that all of them are forwarded to. The listeners of a range share one
+admission policy and one Duo cache, so a client that was admitted on one port is not asked again on
+the others while the cache lasts.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portMapping is the from and to address of one port of a rule
+type portMapping struct {
+	from string
+	to   string
+}
+
+/*
+splitPortRange parses an address such as 0.0.0.0:30000-30100
+
+Returns:
+
+	the host, the first and last port, and true when the port is a range; false for a
+	single port, which is left to the resolver since it can also be a service name
+*/
+func splitPortRange(address string) (string, int, int, bool, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !strings.Contains(port, "-") {
+		return host, 0, 0, false, err
+	}
+	lowText, highText, _ := strings.Cut(port, "-")
+	low, err1 := strconv.Atoi(lowText)
+	high, err2 := strconv.Atoi(highText)
+	if err1 != nil || err2 != nil || low < 1 || high > 65535 || low > high {
+		return "", 0, 0, false, fmt.Errorf("Invalid port range: %s", address)
+	}
+	return host, low, high, true, nil
+}
+
+/*
+portMappings returns the from and to addresses of every port of the rule; a single entry
+unless --from is a port range
+
+Returns:
+
+	the mappings, or an error when a --to port range does not have the size of the --from range
+*/
+func (cfg *ruleConfig) portMappings() ([]portMapping, error) {
+	if _, ok := unixSocketPath(cfg.from); ok {
+		return []portMapping{{from: cfg.from, to: cfg.to}}, nil
+	}
+	host, low, high, ranged, err := splitPortRange(cfg.from)
+	if err != nil {
+		return nil, err
+	}
+
+	type target struct {
+		address  string
+		host     string
+		low      int
+		isRanged bool
+	}
+	var targets []target
+	for _, backend := range splitBackends(cfg.to) {
+		t := target{address: backend}
+		if _, ok := unixSocketPath(backend); !ok {
+			var backendHigh int
+			if t.host, t.low, backendHigh, t.isRanged, err = splitPortRange(backend); err != nil {
+				return nil, err
+			}
+			if t.isRanged && (!ranged || backendHigh-t.low != high-low) {
+				return nil, fmt.Errorf("--to port range must have the same number of ports as the --from port range: %s", backend)
+			}
+		}
+		targets = append(targets, t)
+	}
+	if !ranged {
+		return []portMapping{{from: cfg.from, to: cfg.to}}, nil
+	}
+
+	var mappings []portMapping
+	for offset := 0; offset <= high-low; offset++ {
+		var to []string
+		for _, t := range targets {
+			if t.isRanged {
+				to = append(to, net.JoinHostPort(t.host, strconv.Itoa(t.low+offset)))
+			} else {
+				to = append(to, t.address)
+			}
+		}
+		mappings = append(mappings, portMapping{
+			from: net.JoinHostPort(host, strconv.Itoa(low+offset)),
+			to:   strings.Join(to, ","),
+		})
+	}
+	return mappings, nil
+}
@@ -0,0 +1,247 @@
+/*
+proxy.go
+
+Proxy modes, where the client picks the destination instead of --to: SOCKS5 (--socks5, see
+socks5.go) and HTTP CONNECT (--http-connect, see httpconnect.go). The client is vetted with the
+usual CIDR, geo-ip and Duo checks, and the destination must be in --proxy-allow. With
+--proxy-users, clients log in with a user name and password, and that user name can be used as
+the Duo user (--duo-identity-user).
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// the proxy modes of a rule
+const (
+	proxySOCKS5      = "socks5"
+	proxyHTTPConnect = "http-connect"
+)
+
+var (
+	errDestinationDenied = errors.New("destination not allowed")
+	errAdmissionDenied   = errors.New("client not admitted")
+)
+
+// proxyConfig holds the settings of a --socks5 or --http-connect rule
+type proxyConfig struct {
+	mode      string
+	allowList string
+	allow     []destinationAllow
+	users     map[string]string
+}
+
+// destinationAllow is one entry of --proxy-allow: a CIDR network or host name pattern, with an optional port range
+type destinationAllow struct {
+	network  *net.IPNet
+	host     string
+	portLow  int
+	portHigh int
+}
+
+/*
+parseDestinationAllow reads a --proxy-allow list, for example:
+
+	10.0.0.0/8:22,git.example.com:443,*.corp.example.com:8000-8099,[2001:db8::/32]
+
+Entries without a port allow every port.
+*/
+func parseDestinationAllow(list string) ([]destinationAllow, error) {
+	var allow []destinationAllow
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if 0 == len(entry) {
+			continue
+		}
+		target, ports := entry, ""
+		if strings.HasPrefix(entry, "[") {
+			end := strings.Index(entry, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("Invalid destination: %s", entry)
+			}
+			target, ports = entry[1:end], strings.TrimPrefix(entry[end+1:], ":")
+		} else if pos := strings.LastIndex(entry, ":"); pos >= 0 {
+			target, ports = entry[:pos], entry[pos+1:]
+		}
+
+		a := destinationAllow{portLow: 1, portHigh: 65535}
+		if len(ports) > 0 {
+			low, high, found := strings.Cut(ports, "-")
+			if !found {
+				high = low
+			}
+			var err1, err2 error
+			a.portLow, err1 = strconv.Atoi(low)
+			a.portHigh, err2 = strconv.Atoi(high)
+			if err1 != nil || err2 != nil || a.portLow < 1 || a.portHigh > 65535 || a.portLow > a.portHigh {
+				return nil, fmt.Errorf("Invalid port range in destination: %s", entry)
+			}
+		}
+		if strings.Contains(target, "/") {
+			_, network, err := net.ParseCIDR(target)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid destination: %s", entry)
+			}
+			a.network = network
+		} else if ip := net.ParseIP(target); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			a.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if validSNIPattern(strings.ToLower(target)) && "*" != target {
+			a.host = strings.ToLower(target)
+		} else {
+			return nil, fmt.Errorf("Invalid destination: %s", entry)
+		}
+		allow = append(allow, a)
+	}
+	return allow, nil
+}
+
+func (a destinationAllow) allowsPort(port int) bool {
+	return port >= a.portLow && port <= a.portHigh
+}
+
+// allowsHost returns true when a host name matches the entry's name or wildcard
+func (a destinationAllow) allowsHost(host string) bool {
+	if 0 == len(a.host) {
+		return false
+	}
+	if strings.HasPrefix(a.host, "*.") {
+		return strings.HasSuffix(host, a.host[1:])
+	}
+	return host == a.host
+}
+
+/*
+allowedDestination checks a requested destination against the allow list
+
+A host name is allowed when it matches a host name entry. Otherwise it is resolved and
+every one of its addresses must be in an allowed network; the address that is returned
+is then used for the connection, so that the name can not resolve differently later on.
+
+Returns:
+
+	the address to connect to, or an error when the destination is not allowed
+*/
+func allowedDestination(allow []destinationAllow, host string, port int) (string, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	ip := net.ParseIP(host)
+	if ip == nil {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		for _, a := range allow {
+			if a.allowsPort(port) && a.allowsHost(host) {
+				return address, nil
+			}
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return "", err
+		}
+		if 0 == len(ips) {
+			return "", fmt.Errorf("no address for %s", host)
+		}
+		for _, resolved := range ips {
+			if !allowsIP(allow, resolved, port) {
+				return "", fmt.Errorf("%s (%s) is not an allowed destination", address, resolved)
+			}
+		}
+		return net.JoinHostPort(ips[0].String(), strconv.Itoa(port)), nil
+	}
+	if !allowsIP(allow, ip, port) {
+		return "", fmt.Errorf("%s is not an allowed destination", address)
+	}
+	return address, nil
+}
+
+func allowsIP(allow []destinationAllow, ip net.IP, port int) bool {
+	for _, a := range allow {
+		if a.network != nil && a.allowsPort(port) && a.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyUsers reads an ini file where each section is a user name with a password key
+func readProxyUsers(path string) (map[string]string, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read file: %v", err)
+	}
+	users := make(map[string]string)
+	for _, section := range cfg.Sections() {
+		if ini.DefaultSection == section.Name() {
+			continue
+		}
+		password := section.Key("password").String()
+		if 0 == len(password) {
+			return nil, fmt.Errorf("[%s] no password in %s", section.Name(), path)
+		}
+		users[section.Name()] = password
+	}
+	if 0 == len(users) {
+		return nil, fmt.Errorf("No users found in %s", path)
+	}
+	return users, nil
+}
+
+// checkPassword returns true when the user exists and the password is correct, in constant time
+func (pc *proxyConfig) checkPassword(user string, password string) bool {
+	expected, found := pc.users[user]
+	return found && 1 == subtle.ConstantTimeCompare([]byte(password), []byte(expected))
+}
+
+/*
+proxyConnect checks the destination a proxy client asked for, runs the admission checks and
+connects to the destination
+
+Args:
+
+	src: the client connection
+
+	rule: the rule of the listener
+
+	identity: the proxy user the client logged in as; nil without --proxy-users
+
+	host, port: the destination requested by the client
+
+	queue: the admission workers; only the admission checks take one
+
+Returns:
+
+	the connection to the destination and the admission path; or errDestinationDenied,
+	errAdmissionDenied or the dial error, which have already been logged and counted
+*/
+func proxyConnect(src net.Conn, rule *forwardRule, identity *clientIdentity, host string, port int, queue *admissionQueue) (net.Conn, string, error) {
+	address, err := allowedDestination(rule.proxy.allow, host, port)
+	if err != nil {
+		logger.Warnf("[%v] DENIED; %s", src.RemoteAddr(), err)
+		metricDenied.WithLabelValues(rule.name, "destination_denied").Inc()
+		return nil, "", errDestinationDenied
+	}
+
+	path, ok := queue.admit(src.RemoteAddr(), identity, rule.policy)
+	if !ok {
+		return nil, "", errAdmissionDenied
+	}
+
+	dst, err := rule.dialUpstream(address)
+	if err != nil {
+		errHandler(err, false)
+		metricDenied.WithLabelValues(rule.name, "upstream_error").Inc()
+		return nil, "", err
+	}
+	logger.Infof("[%v] %s CONNECT %s", src.RemoteAddr(), rule.proxy.mode, address)
+	return dst, path, nil
+}
@@ -0,0 +1,224 @@
+/*
+proxyproto.go
+
+HAProxy PROXY protocol, versions 1 and 2: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+With --accept-proxy, connections from the given CIDR networks (eg: a load balancer) must start
+with a PROXY header; the client address in that header is then used for the geo-ip, CIDR and
+Duo checks. With --send-proxy, a PROXY header is sent to the backend so that it sees the
+address of the client instead of the address of gofwd.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximum time a client has to send its PROXY header; load balancers send it right after connecting
+const proxyHeaderTimeout = 3 * time.Second
+
+// maximum length of a version 1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxiedConn is a client connection whose addresses were taken from a PROXY header
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// CloseWrite allows fwd to half-close a proxied client connection
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+/*
+readProxyHeader reads the PROXY header (version 1 or 2) that a trusted peer sends first
+
+Args:
+
+	conn: a connection from one of the --accept-proxy networks
+
+Returns:
+
+	a connection that reports the addresses given in the header and returns the data after
+	it, or an error when the header is missing or invalid. A LOCAL (v2) or UNKNOWN (v1)
+	header keeps the addresses of the connection itself.
+*/
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	proxied := &proxiedConn{Conn: conn, r: r, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY header: %s", err)
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		err = proxied.readV2()
+	} else {
+		err = proxied.readV1()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("PROXY header: %s", err)
+	}
+	return proxied, conn.SetReadDeadline(time.Time{})
+}
+
+func (c *proxiedConn) readV1() error {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+		return err
+	}
+	if len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("invalid v1 header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || "PROXY" != fields[0] {
+		return errors.New("invalid v1 header")
+	}
+	if "UNKNOWN" == fields[1] {
+		return nil
+	}
+	if len(fields) != 6 || ("TCP4" != fields[1] && "TCP6" != fields[1]) {
+		return fmt.Errorf("invalid v1 header: %q", strings.TrimSpace(string(line)))
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return fmt.Errorf("invalid v1 header: %q", strings.TrimSpace(string(line)))
+	}
+	c.remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+func (c *proxiedConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	if 0x20 != header[12]&0xf0 {
+		return fmt.Errorf("unsupported v2 version: %#x", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	if 0x00 == command {
+		// LOCAL: a health check from the proxy itself
+		return nil
+	}
+	if 0x01 != command {
+		return fmt.Errorf("unsupported v2 command: %#x", command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return errors.New("short v2 IPv4 address block")
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		c.local = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return errors.New("short v2 IPv6 address block")
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		c.local = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	default:
+		// UDP, unix sockets or unspecified: keep the addresses of the connection
+	}
+	return nil
+}
+
+/*
+writeProxyHeader sends a PROXY header for a client connection to a backend
+
+Args:
+
+	dst: the backend connection
+
+	version: v1 or v2
+
+	src: the client connection; its remote and local addresses are sent
+*/
+func writeProxyHeader(dst net.Conn, version string, src net.Conn) error {
+	client, clientOK := src.RemoteAddr().(*net.TCPAddr)
+	server, serverOK := src.LocalAddr().(*net.TCPAddr)
+
+	var header []byte
+	if "v1" == version {
+		switch {
+		case !clientOK || !serverOK:
+			header = []byte("PROXY UNKNOWN\r\n")
+		case client.IP.To4() != nil && server.IP.To4() != nil:
+			header = []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", client.IP.To4(), server.IP.To4(), client.Port, server.Port))
+		default:
+			header = []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyIPv6(client.IP), proxyIPv6(server.IP), client.Port, server.Port))
+		}
+	} else {
+		header = append(header, proxyV2Signature...)
+		switch {
+		case !clientOK || !serverOK:
+			header = append(header, 0x20, 0x00, 0x00, 0x00)
+		case client.IP.To4() != nil && server.IP.To4() != nil:
+			header = append(header, 0x21, 0x11, 0x00, 12)
+			header = append(header, client.IP.To4()...)
+			header = append(header, server.IP.To4()...)
+			header = binary.BigEndian.AppendUint16(header, uint16(client.Port))
+			header = binary.BigEndian.AppendUint16(header, uint16(server.Port))
+		default:
+			header = append(header, 0x21, 0x21, 0x00, 36)
+			header = append(header, client.IP.To16()...)
+			header = append(header, server.IP.To16()...)
+			header = binary.BigEndian.AppendUint16(header, uint16(client.Port))
+			header = binary.BigEndian.AppendUint16(header, uint16(server.Port))
+		}
+	}
+	_, err := dst.Write(header)
+	return err
+}
+
+// proxyIPv6 formats an address for a v1 TCP6 header, which requires both addresses to be IPv6
+func proxyIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
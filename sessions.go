@@ -0,0 +1,196 @@
+/*
+sessions.go
+
+Keeps track of every forwarded connection so that a shutdown can wait for
+them to finish (drain) and forcefully close whatever is left afterwards.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the ways in which a session can end; only the first one to happen is recorded
+const (
+	closeClientEOF   = "client EOF"
+	closeUpstreamEOF = "upstream EOF"
+	closeError       = "error"
+	closeShutdown    = "shutdown"
+	closeIdleTimeout = "idle timeout"
+	closeMaxSession  = "max session"
+	closeUpstreamTLS = "upstream TLS handshake"
+)
+
+// forwardSession is a client connection and its upstream connection
+type forwardSession struct {
+	src      net.Conn
+	dst      net.Conn
+	listener string
+	path     string
+	start    time.Time
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu          sync.Mutex
+	closeReason string
+}
+
+func newForwardSession(src net.Conn, dst net.Conn, listener string, path string) *forwardSession {
+	return &forwardSession{src: src, dst: dst, listener: listener, path: path, start: time.Now()}
+}
+
+func (s *forwardSession) close() {
+	s.src.Close()
+	s.dst.Close()
+}
+
+// setCloseReason records why the session ended, unless a reason was already recorded
+func (s *forwardSession) setCloseReason(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if 0 == len(s.closeReason) {
+		s.closeReason = reason
+	}
+}
+
+/*
+watch closes the session once it has been idle or open for too long
+
+Args:
+
+	idleTimeout: maximum time without any data in either direction; 0 to disable
+
+	maxSession: maximum lifetime of the session; 0 to disable
+
+	done: closed when the session has ended
+*/
+func (s *forwardSession) watch(idleTimeout time.Duration, maxSession time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastTotal := int64(0)
+	lastActive := s.start
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if maxSession > 0 && now.Sub(s.start) >= maxSession {
+				s.setCloseReason(closeMaxSession)
+				s.close()
+				return
+			}
+			if total := s.bytesIn.Load() + s.bytesOut.Load(); total != lastTotal {
+				lastTotal = total
+				lastActive = now
+			}
+			if idleTimeout > 0 && now.Sub(lastActive) >= idleTimeout {
+				s.setCloseReason(closeIdleTimeout)
+				s.close()
+				return
+			}
+		}
+	}
+}
+
+// logSummary emits the session record once both directions are finished
+func (s *forwardSession) logSummary() {
+	s.mu.Lock()
+	reason := s.closeReason
+	s.mu.Unlock()
+
+	end := time.Now()
+	logger.Infow(fmt.Sprintf("[%v] CLOSED", s.src.RemoteAddr()),
+		"listener", s.listener,
+		"upstream", s.dst.RemoteAddr().String(),
+		"start", s.start.Format(time.RFC3339Nano),
+		"end", end.Format(time.RFC3339Nano),
+		"duration", end.Sub(s.start).String(),
+		"bytes_in", s.bytesIn.Load(),
+		"bytes_out", s.bytesOut.Load(),
+		"admission", s.path,
+		"close", reason,
+	)
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	closing  bool
+	sessions map[*forwardSession]struct{}
+}
+
+// activeSessions contains every session that is currently being forwarded
+var activeSessions = newSessionRegistry()
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[*forwardSession]struct{})}
+}
+
+// add registers a new session; it returns false once a shutdown has started
+func (r *sessionRegistry) add(s *forwardSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closing {
+		return false
+	}
+	r.sessions[s] = struct{}{}
+	r.wg.Add(1)
+	return true
+}
+
+// remove is called once both directions of a session are finished
+func (r *sessionRegistry) remove(s *forwardSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.sessions[s]; !found {
+		return
+	}
+	delete(r.sessions, s)
+	r.wg.Done()
+}
+
+/*
+drain refuses new sessions and waits for the current ones to finish
+
+Args:
+
+	timeout: how long to wait before the remaining sessions are closed
+
+Returns:
+
+	the number of sessions that finished on their own and the number that were closed
+*/
+func (r *sessionRegistry) drain(timeout time.Duration) (int, int) {
+	r.mu.Lock()
+	r.closing = true
+	total := len(r.sessions)
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return total, 0
+	case <-time.After(timeout):
+	}
+
+	r.mu.Lock()
+	killed := len(r.sessions)
+	for s := range r.sessions {
+		s.setCloseReason(closeShutdown)
+		s.close()
+	}
+	r.mu.Unlock()
+	<-done
+	return total - killed, killed
+}
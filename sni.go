@@ -0,0 +1,139 @@
+/*
+sni.go
+
+SNI routing: several rules in a --config file can share one --from address when each of
+them has an sni key. The server name that the client sends in its TLS ClientHello picks
+the rule, and with it the backends and the geo-ip, CIDR and Duo restrictions. The TLS
+connection itself is not terminated; the ClientHello is passed on to the backend as is.
+
+	sni=git.example.com     only this name
+	sni=*.example.com       any name ending in .example.com
+	sni=*                   every other name, including clients that send no name
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// errHelloRead stops the handshake in peekServerName once the ClientHello has been read
+var errHelloRead = errors.New("ClientHello read")
+
+// helloConn lets crypto/tls read a ClientHello while keeping a copy of every byte read; writes are discarded
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c helloConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// replayConn returns the bytes that were already read from a connection before reading from the connection itself
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite allows fwd to half-close a connection that was peeked at
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+/*
+peekServerName reads the TLS ClientHello of a new connection without answering it
+
+Args:
+
+	conn: a client connection that starts with a TLS handshake
+
+Returns:
+
+	a connection that returns the ClientHello again when it is read, so that it can be
+	forwarded, and the server name the client asked for, which is empty when it did not
+	send one; or an error when the connection does not start with a ClientHello
+*/
+func peekServerName(conn net.Conn) (net.Conn, string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return nil, "", err
+	}
+
+	var hello bytes.Buffer
+	var serverName string
+	found := false
+	config := &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = strings.ToLower(info.ServerName)
+			found = true
+			return nil, errHelloRead
+		},
+	}
+	err := tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &hello)}, config).Handshake()
+	if !found {
+		return nil, "", fmt.Errorf("TLS ClientHello: %s", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, "", err
+	}
+	return &replayConn{Conn: conn, r: io.MultiReader(&hello, conn)}, serverName, nil
+}
+
+// validSNIPattern checks the sni key of a rule
+func validSNIPattern(pattern string) bool {
+	if "*" == pattern {
+		return true
+	}
+	name := strings.TrimPrefix(pattern, "*.")
+	return len(name) > 0 && !strings.ContainsAny(name, "*:/ ")
+}
+
+// sniRoutes are the rules that share a listener, each for its own server name pattern
+type sniRoutes struct {
+	rules []*forwardRule
+}
+
+/*
+match returns the rule for a server name, or nil when no rule matches
+
+An exact name is preferred over a wildcard, a longer wildcard over a shorter one and
+any of them over the default route (*).
+*/
+func (r *sniRoutes) match(serverName string) *forwardRule {
+	var best *forwardRule
+	bestLength := -1
+	for _, rule := range r.rules {
+		pattern := rule.sni
+		length := -1
+		switch {
+		case pattern == serverName:
+			length = len(pattern) + 1
+		case "*" == pattern:
+			length = 0
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(serverName, pattern[1:]):
+			length = len(pattern)
+		}
+		if length > bestLength {
+			best, bestLength = rule, length
+		}
+	}
+	return best
+}
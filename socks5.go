@@ -0,0 +1,234 @@
+/*
+socks5.go
+
+SOCKS5 mode (RFC 1928), see proxy.go. With --proxy-users, clients authenticate with a
+user name and password (RFC 1929). Only the CONNECT command is supported.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	socksVersion        = 0x05
+	socksAuthNone       = 0x00
+	socksAuthPassword   = 0x02
+	socksNoAcceptable   = 0xff
+	socksCmdConnect     = 0x01
+	socksAddrIPv4       = 0x01
+	socksAddrDomain     = 0x03
+	socksAddrIPv6       = 0x04
+	socksSucceeded      = 0x00
+	socksNotAllowed     = 0x02
+	socksUnreachable    = 0x04
+	socksRefused        = 0x05
+	socksCmdNotSupport  = 0x07
+	socksAddrNotSupport = 0x08
+)
+
+// maximum time a client has to send its greeting, credentials and request
+const socksHandshakeTimeout = 30 * time.Second
+
+/*
+socksHandshake reads the client's greeting, credentials and CONNECT request
+
+Returns:
+
+	the identity of the client (nil without --proxy-users), the requested host and port,
+	or an error; failures that the client should know about have already been answered
+*/
+func (pc *proxyConfig) socksHandshake(conn net.Conn) (*clientIdentity, string, int, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, "", 0, err
+	}
+	if socksVersion != header[0] {
+		return nil, "", 0, fmt.Errorf("not a SOCKS5 client: version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, "", 0, err
+	}
+
+	method := byte(socksAuthNone)
+	if pc.users != nil {
+		method = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return nil, "", 0, errors.New("SOCKS5 client does not support the required authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, "", 0, err
+	}
+
+	var identity *clientIdentity
+	if pc.users != nil {
+		user, err := pc.socksAuthenticate(conn)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		identity = &clientIdentity{source: "socks5", name: user}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return identity, "", 0, err
+	}
+	if socksVersion != request[0] {
+		return identity, "", 0, fmt.Errorf("invalid SOCKS5 request version: %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if socksAddrIPv6 == request[3] {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return identity, "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return identity, "", 0, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return identity, "", 0, err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAddrNotSupport, nil)
+		return identity, "", 0, fmt.Errorf("unsupported SOCKS5 address type: %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return identity, "", 0, err
+	}
+
+	if socksCmdConnect != request[1] {
+		socksReply(conn, socksCmdNotSupport, nil)
+		return identity, "", 0, fmt.Errorf("unsupported SOCKS5 command: %d", request[1])
+	}
+	return identity, host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// authenticate runs the RFC 1929 user name / password exchange
+func (pc *proxyConfig) socksAuthenticate(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return "", err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+
+	if !pc.checkPassword(string(user), string(password)) {
+		conn.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("SOCKS5 authentication failed for user: %q", user)
+	}
+	_, err := conn.Write([]byte{0x01, 0x00})
+	return string(user), err
+}
+
+// socksReply answers a request; bound is the local address of the connection to the destination, if any
+func socksReply(conn net.Conn, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0x00}
+	tcp, ok := bound.(*net.TCPAddr)
+	switch {
+	case !ok:
+		reply = append(reply, socksAddrIPv4, 0, 0, 0, 0, 0, 0)
+	case tcp.IP.To4() != nil:
+		reply = append(reply, socksAddrIPv4)
+		reply = append(reply, tcp.IP.To4()...)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(tcp.Port))
+	default:
+		reply = append(reply, socksAddrIPv6)
+		reply = append(reply, tcp.IP.To16()...)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(tcp.Port))
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+/*
+socksForward handles a client of a --socks5 rule: handshake, destination and admission checks,
+then the connection to the destination
+
+Args:
+
+	src: the client connection
+
+	rule: the rule of the listener
+
+	queue: the admission workers; only the admission checks take one
+*/
+func socksForward(src net.Conn, rule *forwardRule, queue *admissionQueue) {
+	if err := src.SetDeadline(time.Now().Add(socksHandshakeTimeout)); err != nil {
+		src.Close()
+		return
+	}
+	identity, host, port, err := rule.proxy.socksHandshake(src)
+	if err != nil {
+		logger.Warnf("[%v] DENIED; %s", src.RemoteAddr(), err)
+		metricDenied.WithLabelValues(rule.name, "socks_error").Inc()
+		src.Close()
+		return
+	}
+	// admission may wait for a Duo push, which is not bound by the handshake timeout
+	if err := src.SetDeadline(time.Time{}); err != nil {
+		errHandler(err, false)
+	}
+
+	dst, path, err := proxyConnect(src, rule, identity, host, port, queue)
+	src.SetWriteDeadline(time.Now().Add(socksHandshakeTimeout))
+	switch {
+	case err == nil:
+	case errors.Is(err, errDestinationDenied), errors.Is(err, errAdmissionDenied):
+		socksReply(src, socksNotAllowed, nil)
+		src.Close()
+		return
+	case errors.Is(err, syscall.ECONNREFUSED):
+		socksReply(src, socksRefused, nil)
+		src.Close()
+		return
+	default:
+		socksReply(src, socksUnreachable, nil)
+		src.Close()
+		return
+	}
+	if err := socksReply(src, socksSucceeded, dst.LocalAddr()); err != nil {
+		errHandler(err, false)
+		src.Close()
+		dst.Close()
+		return
+	}
+	if err := src.SetWriteDeadline(time.Time{}); err != nil {
+		errHandler(err, false)
+	}
+	forward(newForwardSession(src, dst, rule.name, path), rule, func() {})
+}
@@ -0,0 +1,290 @@
+/*
+tls.go
+
+TLS termination: with --tls-cert and --tls-key, clients connect with TLS and the
+decrypted stream is forwarded to the --to backend. The certificate files are checked
+for changes (eg: after a renewal) at most every certReloadInterval and are reloaded
+without a restart. With --tls-client-ca, clients must also present a certificate; its
+identity can be required (--tls-client-allow), can replace other checks (--tls-client-skip)
+and can be used as the Duo user name (--duo-identity-user).
+
+TLS origination: with --to-tls, the connection to the backend is wrapped in TLS, for
+backends that only accept TLS while clients connect in plain text.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often the certificate files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+// maximum time a client has to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersionName returns the --tls-min-version name of a TLS version
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("%#x", version)
+}
+
+// certReloader serves a certificate and key pair, reloading them when either file changes
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTimes  [2]time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the certificate and key; the caller must hold mu unless r is not shared yet
+func (r *certReloader) load() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load TLS certificate: %s", err)
+	}
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.lastCheck = time.Now()
+	return nil
+}
+
+func (r *certReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate; a certificate that can not be reloaded is logged and the previous one is kept
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) < certReloadInterval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+
+	modTimes, err := r.stat()
+	if err != nil {
+		logger.Warnf("TLS certificate check failed, keeping the current certificate: %s", err)
+		return r.cert, nil
+	}
+	if modTimes == r.modTimes {
+		return r.cert, nil
+	}
+	if err := r.load(); err != nil {
+		logger.Warnf("%s; keeping the current certificate", err)
+		return r.cert, nil
+	}
+	logger.Infof("TLS certificate reloaded: %s", r.certFile)
+	return r.cert, nil
+}
+
+/*
+newServerTLSConfig returns the TLS settings for a listener
+
+Args:
+
+	certFile, keyFile: the listener's certificate and private key
+
+	minVersion: the minimum TLS version, eg: 1.2
+
+	clientCA: when not empty, clients must present a certificate signed by one of the CAs in this PEM file
+
+Returns:
+
+	the settings, or an error when a file can not be loaded
+*/
+func newServerTLSConfig(certFile string, keyFile string, minVersion string, clientCA string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tlsVersions[minVersion],
+	}
+	if len(clientCA) > 0 {
+		if config.ClientCAs, err = loadCertPool(clientCA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// certIdentity returns the identity of a verified client certificate: its subject CN (or first SAN) and all of its SANs
+func certIdentity(conn *tls.Conn) *clientIdentity {
+	state := conn.ConnectionState()
+	if 0 == len(state.PeerCertificates) {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	id := &clientIdentity{source: "cert", name: cert.Subject.CommonName}
+	id.names = append(id.names, cert.DNSNames...)
+	id.names = append(id.names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		id.names = append(id.names, uri.String())
+	}
+	if 0 == len(id.name) && len(id.names) > 0 {
+		id.name = id.names[0]
+	}
+	return id
+}
+
+// tlsHandshake starts TLS on an accepted connection and waits for the handshake to finish
+func tlsHandshake(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, config)
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %s", err)
+	}
+	return tlsConn, conn.SetDeadline(time.Time{})
+}
+
+// how the certificate of a TLS backend is verified
+const (
+	verifyFull   = "full"
+	verifyCAOnly = "ca-only"
+	verifyNone   = "none"
+)
+
+/*
+newUpstreamTLSConfig returns the TLS settings for connections to the backends of a rule
+
+Args:
+
+	sni: the server name to send and verify; when empty, the host name of each backend is used
+
+	caFile: PEM bundle of CAs to verify the backend with instead of the system CAs
+
+	certFile, keyFile: an optional client certificate to present to the backend
+
+	verify: full (chain and host name), ca-only (chain only) or none
+
+Returns:
+
+	the settings, or an error when a file can not be loaded
+*/
+func newUpstreamTLSConfig(sni string, caFile string, certFile string, keyFile string, verify string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: sni, MinVersion: tls.VersionTLS12}
+	if len(caFile) > 0 {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load TLS client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch verify {
+	case verifyNone:
+		// #nosec G402 -- explicitly requested with --to-tls-verify none
+		config.InsecureSkipVerify = true
+	case verifyCAOnly:
+		// #nosec G402 -- the chain is still verified below, only the host name is not
+		config.InsecureSkipVerify = true
+		roots := config.RootCAs
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	}
+	return config, nil
+}
+
+// verifyChain checks that a certificate chain is signed by roots (the system CAs when nil), without checking the host name
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if 0 == len(rawCerts) {
+		return fmt.Errorf("no certificate received")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// upstreamHandshake starts TLS on a backend connection; address is the backend, used for SNI when no name was configured
+func upstreamHandshake(conn net.Conn, config *tls.Config, address string) (*tls.Conn, error) {
+	if 0 == len(config.ServerName) {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("upstream TLS handshake with %s: %s", address, err)
+	}
+	return tlsConn, conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for commonName and its key as PEM files
+func writeTestCert(t *testing.T, certFile string, keyFile string, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testCertFiles returns the paths of a certificate and key in a temporary directory
+func testCertFiles(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+// servedName returns the common name of the certificate that r serves
+func servedName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	certFile, keyFile := testCertFiles(t)
+	writeTestCert(t, certFile, keyFile, "first.example.com")
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, r); "first.example.com" != name {
+		t.Fatalf("served %s, want first.example.com", name)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second.example.com")
+	// make sure the rewrite is seen as a change, whatever the file system's time resolution
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{certFile, keyFile} {
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name := servedName(t, r); "first.example.com" != name {
+		t.Errorf("served %s before certReloadInterval passed, want first.example.com", name)
+	}
+
+	r.lastCheck = time.Time{}
+	if name := servedName(t, r); "second.example.com" != name {
+		t.Errorf("served %s after the files changed, want second.example.com", name)
+	}
+
+	// a broken rewrite keeps the current certificate
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	r.lastCheck = time.Time{}
+	if name := servedName(t, r); "second.example.com" != name {
+		t.Errorf("served %s after a broken rewrite, want second.example.com", name)
+	}
+}
+
+func TestTLSHandshakeMinVersion(t *testing.T) {
+	certFile, keyFile := testCertFiles(t)
+	writeTestCert(t, certFile, keyFile, "localhost")
+	config, err := newServerTLSConfig(certFile, keyFile, "1.3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		clientMax uint16
+		accepted  bool
+	}{
+		{tls.VersionTLS12, false},
+		{tls.VersionTLS13, true},
+	}
+	for _, tt := range tests {
+		t.Run(tlsVersionName(tt.clientMax), func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			result := make(chan error, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					result <- err
+					return
+				}
+				defer conn.Close()
+				_, err = tlsHandshake(conn, config)
+				result <- err
+			}()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			client := tls.Client(conn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true, MaxVersion: tt.clientMax})
+			clientErr := client.Handshake()
+
+			serverErr := <-result
+			if tt.accepted && (clientErr != nil || serverErr != nil) {
+				t.Errorf("handshake failed: client: %v; server: %v", clientErr, serverErr)
+			}
+			if !tt.accepted && serverErr == nil {
+				t.Errorf("TLS %s client was accepted with --tls-min-version 1.3", tlsVersionName(tt.clientMax))
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+/*
+udp.go
+
+UDP forwarding: every client address gets its own upstream socket so that replies
+can be routed back. The admission checks (CIDR, GeoIP, Duo) run once per new
+session instead of once per packet. Sessions expire after being idle.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	udpSessionPending int32 = iota
+	udpSessionAllowed
+	udpSessionDenied
+)
+
+// maximum number of packets held for a client while its session is being admitted
+const udpMaxPendingPackets = 16
+
+const udpMaxPacketSize = 65535
+
+type udpSession struct {
+	client   *net.UDPAddr
+	upstream *net.UDPConn
+	backend  *backend
+	closed   sync.Once
+	state    atomic.Int32
+	lastSeen atomic.Int64
+
+	// set once the session is allowed
+	listener string
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+
+	mu      sync.Mutex
+	pending [][]byte
+}
+
+func (s *udpSession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// deny drops the client's packets; they do not touch a denied session, which therefore expires one udp
+// timeout after the denial so that a client that keeps sending is admitted again
+func (s *udpSession) deny() {
+	s.touch()
+	s.state.Store(udpSessionDenied)
+}
+
+// close closes the upstream socket of an allowed session; it is safe to call more than once
+func (s *udpSession) close() {
+	s.closed.Do(func() {
+		s.upstream.Close()
+		s.backend.release()
+		metricActiveSessions.WithLabelValues(s.listener).Dec()
+	})
+}
+
+// write forwards a packet from the client to the upstream socket of an allowed session
+func (s *udpSession) write(packet []byte) {
+	n, err := s.upstream.Write(packet)
+	s.bytesIn.Add(float64(n))
+	errHandler(err, false)
+}
+
+type udpForwarder struct {
+	listener *net.UDPConn
+	rl       *ruleListener
+	queue    *admissionQueue
+
+	mu       sync.Mutex
+	closed   bool
+	sessions map[string]*udpSession
+}
+
+func newUDPForwarder(listener *net.UDPConn, rl *ruleListener) *udpForwarder {
+	return &udpForwarder{
+		listener: listener,
+		rl:       rl,
+		sessions: make(map[string]*udpSession),
+	}
+}
+
+// serve reads packets until the listener is closed; sessions can not outlive it since replies are sent from the listening socket
+func (f *udpForwarder) serve(queue *admissionQueue) {
+	f.queue = queue
+	defer f.listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go f.expireSessions(done)
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, client, err := f.listener.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			f.closeSessions()
+			return
+		}
+		errHandler(err, true)
+		f.handlePacket(client, buf[:n])
+	}
+}
+
+// handlePacket forwards a packet for an admitted client, queues it while the client is being admitted, or drops it
+func (f *udpForwarder) handlePacket(client *net.UDPAddr, packet []byte) {
+	key := client.String()
+
+	f.mu.Lock()
+	session, found := f.sessions[key]
+	if !found {
+		session = &udpSession{client: client}
+		f.sessions[key] = session
+	}
+	if session.state.Load() != udpSessionDenied {
+		session.touch()
+	}
+	f.mu.Unlock()
+
+	if !found {
+		if rule := f.rl.rule.Load(); !rule.backends.healthy() {
+			logger.Warnf("[%v] DENIED; no healthy backend for rule: %s", client, rule.name)
+			metricDenied.WithLabelValues(rule.name, "unhealthy").Inc()
+			session.deny()
+			return
+		}
+		session.pending = append(session.pending, append([]byte(nil), packet...))
+		go f.admitSession(session)
+		return
+	}
+
+	switch session.state.Load() {
+	case udpSessionAllowed:
+		session.write(packet)
+	case udpSessionPending:
+		session.mu.Lock()
+		if session.state.Load() == udpSessionAllowed {
+			// admission finished while waiting for the lock
+			session.mu.Unlock()
+			session.write(packet)
+			return
+		}
+		if len(session.pending) < udpMaxPendingPackets {
+			session.pending = append(session.pending, append([]byte(nil), packet...))
+		}
+		session.mu.Unlock()
+	}
+}
+
+// admitSession runs the admission checks for a new client and then opens its upstream socket
+func (f *udpForwarder) admitSession(session *udpSession) {
+	rule := f.rl.rule.Load()
+	if _, ok := f.queue.admit(session.client, nil, rule.policy); !ok {
+		session.deny()
+		session.mu.Lock()
+		session.pending = nil
+		session.mu.Unlock()
+		return
+	}
+
+	conn, backend, err := rule.dialBackend(addrIP(session.client))
+	if err != nil {
+		errHandler(err, false)
+		session.deny()
+		return
+	}
+	upstream := conn.(*net.UDPConn)
+
+	session.mu.Lock()
+	session.upstream = upstream
+	session.backend = backend
+	session.listener = rule.name
+	session.bytesIn = metricBytes.WithLabelValues(rule.name, "in")
+	session.bytesOut = metricBytes.WithLabelValues(rule.name, "out")
+	metricActiveSessions.WithLabelValues(rule.name).Inc()
+	for _, packet := range session.pending {
+		session.write(packet)
+	}
+	session.pending = nil
+	session.state.Store(udpSessionAllowed)
+	session.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		// the listener was removed while this session was being admitted
+		session.close()
+		return
+	}
+	go f.relayReplies(session)
+}
+
+/*
+relayReplies copies packets from the upstream socket back to the client until the session is closed
+
+A connected UDP socket reports ECONNREFUSED after an ICMP port unreachable, eg: while the backend
+restarts; the read is retried. Any other error ends the session, so that the client's next packet
+is admitted as a new session instead of never getting a reply.
+*/
+func (f *udpForwarder) relayReplies(session *udpSession) {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := session.upstream.Read(buf)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("[%v] UDP session closed: %s", session.client, err)
+			}
+			f.removeSession(session)
+			return
+		}
+		session.touch()
+		n, err = f.listener.WriteToUDP(buf[:n], session.client)
+		session.bytesOut.Add(float64(n))
+		errHandler(err, false)
+	}
+}
+
+// removeSession forgets a session, unless it was already replaced, and closes it
+func (f *udpForwarder) removeSession(session *udpSession) {
+	f.mu.Lock()
+	key := session.client.String()
+	if f.sessions[key] == session {
+		delete(f.sessions, key)
+	}
+	f.mu.Unlock()
+	session.close()
+}
+
+// expireSessions removes sessions, including denied ones, that have been idle for longer than the rule's udp timeout
+func (f *udpForwarder) expireSessions(done chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		idleTimeout := f.rl.rule.Load().udpTimeout
+		cutoff := time.Now().Add(-idleTimeout).UnixNano()
+		f.mu.Lock()
+		for key, session := range f.sessions {
+			if session.lastSeen.Load() > cutoff || session.state.Load() == udpSessionPending {
+				continue
+			}
+			delete(f.sessions, key)
+			if session.state.Load() == udpSessionAllowed {
+				session.close()
+				logger.Infof("[%v] UDP session expired after %v idle", session.client, idleTimeout)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// closeSessions closes every upstream socket once the listener is gone
+func (f *udpForwarder) closeSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for key, session := range f.sessions {
+		delete(f.sessions, key)
+		if session.state.Load() == udpSessionAllowed {
+			session.close()
+		}
+	}
+}
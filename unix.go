@@ -0,0 +1,142 @@
+/*
+unix.go
+
+Unix domain sockets: --from and --to also accept unix:/path/to.sock. A Unix socket backend,
+such as /var/run/docker.sock or a database socket, can then be exposed over TCP with the usual
+geo-ip, CIDR and Duo checks in front of it, and a Unix socket listener can forward to a remote
+TCP service. Clients of a Unix socket listener are local and have no IP address, so the CIDR
+and geo-ip checks do not apply to them; the socket file's permissions (--unix-mode) decide who
+can connect, and Duo still applies.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const unixPrefix = "unix:"
+
+// unixClientAddr is reported as the address of clients of a Unix socket listener, which have none
+var unixClientAddr = &net.UnixAddr{Name: "local", Net: "unix"}
+
+// unixSocketPath returns the path of a unix:/path.sock address
+func unixSocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, unixPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, unixPrefix), true
+}
+
+// dialNetwork returns the network and address to pass to net.Dial for a rule's proto and a --to address
+func dialNetwork(proto string, address string) (string, string) {
+	if path, ok := unixSocketPath(address); ok {
+		return "unix", path
+	}
+	return proto, address
+}
+
+// parseUnixMode reads the octal --unix-mode, eg: 0660
+func parseUnixMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("Invalid --unix-mode, must be octal such as 0660: %s", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+/*
+listenUnix creates a Unix socket listener, replacing a socket file left behind by a process that
+is no longer running
+
+The socket is created in a private directory next to path and only moved to path once it has its
+final permissions, so that it is never reachable with wider permissions than mode.
+
+Args:
+
+	path: the socket file
+
+	mode: the permissions of the socket file
+
+Returns:
+
+	the listener, which removes the socket file when it is closed; or an error when the path is
+	not a socket or another process is still listening on it
+*/
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".gofwd-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket file is removed by unixListener.Close under its final name
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// unixListener removes its socket file when it is closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// removeStaleSocket removes a socket file that nothing is listening on anymore
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if 0 == info.Mode()&os.ModeSocket {
+		return fmt.Errorf("%s already exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	logger.Infof("removing stale socket: %s", path)
+	return os.Remove(path)
+}
+
+// unixClientConn is an accepted Unix socket connection; it reports unixClientAddr as the client address
+type unixClientConn struct {
+	*net.UnixConn
+}
+
+func (c unixClientConn) RemoteAddr() net.Addr {
+	return unixClientAddr
+}